@@ -0,0 +1,52 @@
+// Command autobahn runs an echo server for the fuzzingclient of the Autobahn
+// WebSocket Testsuite, see the README of the repository for how to run it.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/asynched/golang-websocket-impl/internal/ws"
+)
+
+func main() {
+	addr := flag.String("addr", ":9001", "address to listen on")
+	flag.Parse()
+
+	upgrader := &ws.Upgrader{
+		EnableCompression: true,
+		StrictMode:        true,
+	}
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r)
+
+		if err != nil {
+			log.Printf("Failed to upgrade connection: %v\n", err)
+			return
+		}
+
+		defer conn.Close()
+
+		// Messages are echoed whole with their type, which is what every
+		// case of the suite expects back.
+		for {
+			messageType, data, err := conn.ReadMessage()
+
+			if err != nil {
+				return
+			}
+
+			if err := conn.WriteMessage(messageType, data); err != nil {
+				return
+			}
+		}
+	})
+
+	log.Printf("Autobahn echo server started on %s\n", *addr)
+
+	if err := http.ListenAndServe(*addr, nil); err != nil {
+		log.Fatalf("Server failed: %v\n", err)
+	}
+}
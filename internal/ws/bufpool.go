@@ -0,0 +1,54 @@
+package ws
+
+import (
+	"bytes"
+	"sync"
+)
+
+// maxPooledMessageBuffer is the capacity above which message buffers are
+// not pooled, so a single large message does not pin its memory.
+const maxPooledMessageBuffer = 64 << 10
+
+// readBufferPool holds the read buffers shared by connections upgraded
+// with Upgrader.PoolReadBuffers set.
+var readBufferPool sync.Pool
+
+// getReadBuffer returns a pooled buffer of the given size, or a new one if
+// the pool holds none of that size.
+func getReadBuffer(size int) []byte {
+	if p, ok := readBufferPool.Get().(*[]byte); ok && cap(*p) == size {
+		return (*p)[:size]
+	}
+
+	return make([]byte, size)
+}
+
+// putReadBuffer returns buf to the pool unless it grew past size.
+func putReadBuffer(buf []byte, size int) {
+	if cap(buf) != size {
+		return
+	}
+
+	readBufferPool.Put(&buf)
+}
+
+// messageBufferPool holds the buffers messages are assembled in by
+// ReadMessage and ReadJSON.
+var messageBufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// getMessageBuffer returns an empty pooled buffer.
+func getMessageBuffer() *bytes.Buffer {
+	return messageBufferPool.Get().(*bytes.Buffer)
+}
+
+// putMessageBuffer returns buf to the pool unless it grew too large.
+func putMessageBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledMessageBuffer {
+		return
+	}
+
+	buf.Reset()
+	messageBufferPool.Put(buf)
+}
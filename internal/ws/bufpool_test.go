@@ -0,0 +1,41 @@
+package ws
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/asynched/golang-websocket-impl/internal/wstest"
+)
+
+func TestPoolReadBuffers(t *testing.T) {
+	const conns = 100
+
+	in := wstest.BuildFrame(true, opCodeText, true, testMask, []byte("hello"))
+
+	for _, pooled := range []bool{false, true} {
+		resident := 0
+
+		for range conns {
+			c := newTestConn(bytes.NewReader(in), io.Discard)
+
+			if pooled {
+				c.readBuf = nil
+				c.poolReadBuffer = true
+			}
+
+			if _, data, err := c.ReadMessage(); err != nil || string(data) != "hello" {
+				t.Fatalf("pooled %v: got %q %v", pooled, data, err)
+			}
+
+			if c.readBuf != nil {
+				resident++
+			}
+		}
+
+		// Idle connections only hold a read buffer without pooling.
+		if want := map[bool]int{false: conns, true: 0}[pooled]; resident != want {
+			t.Fatalf("pooled %v: %d idle connections hold a read buffer, want %d", pooled, resident, want)
+		}
+	}
+}
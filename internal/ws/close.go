@@ -0,0 +1,139 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"unicode/utf8"
+)
+
+// ErrInvalidClosePayload is returned when the peer sends a Close frame with
+// a single byte of payload, which cannot hold a status code.
+var ErrInvalidClosePayload = errors.New("close frame payload too short for a status code")
+
+// ErrInvalidCloseCode is returned when configuring or sending a status code
+// that may not be sent in a Close frame, such as CloseNoStatusReceived.
+var ErrInvalidCloseCode = errors.New("status code cannot be sent in a close frame")
+
+// CloseError is returned when the peer closed the connection with a Close
+// frame. Code is CloseNoStatusReceived if the frame carried no status code.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	if e.Text == "" {
+		return "websocket closed with code " + strconv.Itoa(e.Code)
+	}
+
+	return "websocket closed with code " + strconv.Itoa(e.Code) + ": " + e.Text
+}
+
+// validCloseCode reports whether code may be sent in a Close frame, as
+// described in section 7.4 of RFC 6455 and the IANA registry.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	default:
+		return false
+	}
+}
+
+// parseClosePayload returns the status code and reason of a Close frame.
+func parseClosePayload(payload []byte) (int, string) {
+	if len(payload) < 2 {
+		return CloseNoStatusReceived, ""
+	}
+
+	return int(payload[0])<<0x08 | int(payload[1]), string(payload[2:])
+}
+
+// handleClose answers a Close frame received from the peer and closes the
+// underlying connection. The response mirrors the received status code
+// unless echoing is disabled, while an invalid code is answered with
+// CloseProtocolError.
+func (c *connImpl) handleClose(payload []byte) error {
+	// The payload is either empty or starts with a 2 byte status code.
+	if len(payload) == 1 {
+		return c.fail(CloseProtocolError, ErrInvalidClosePayload)
+	}
+
+	code, reason := parseClosePayload(payload)
+
+	if c.strict && !utf8.ValidString(reason) {
+		return c.fail(CloseInvalidFramePayloadData, ErrInvalidUTF8)
+	}
+
+	response := code
+
+	if len(payload) == 0 || c.disableCloseEcho {
+		response = CloseNormalClosure
+	}
+
+	// Codes such as CloseNoStatusReceived are only reported locally, the
+	// peer may not put them on the wire.
+	if len(payload) != 0 && !validCloseCode(code) {
+		response = CloseProtocolError
+	}
+
+	err := &CloseError{Code: code, Text: reason}
+
+	c.writeClose(response, "")
+	c.closeConn(err)
+
+	return err
+}
+
+func (c *connImpl) CloseGracefully(ctx context.Context, code int, reason string) error {
+	if !validCloseCode(code) {
+		return ErrInvalidCloseCode
+	}
+
+	if c.truncateCloseReason {
+		reason = truncateUTF8(reason, maxCloseReasonLength)
+	}
+
+	if len(reason) > maxCloseReasonLength {
+		return ErrCloseReasonTooLong
+	}
+
+	// Cancelling the context closes the connection, which interrupts the
+	// read waiting for the peer's Close frame.
+	stop := context.AfterFunc(ctx, func() { c.closeConn(ctx.Err()) })
+	defer stop()
+
+	if err := c.writeClose(code, reason); err != nil {
+		c.closeConn(err)
+		return err
+	}
+
+	for {
+		f, err := c.readFrame()
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err != nil {
+			c.closeConn(err)
+			return err
+		}
+
+		// Data frames and pings are discarded, nothing may be sent after a
+		// Close frame but the underlying connection being closed.
+		if f.opCode == opCodeClose {
+			code, reason := parseClosePayload(f.payload)
+			err := &CloseError{Code: code, Text: reason}
+
+			c.closeConn(err)
+
+			return err
+		}
+	}
+}
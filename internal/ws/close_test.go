@@ -0,0 +1,251 @@
+package ws
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/asynched/golang-websocket-impl/internal/wstest"
+)
+
+// closeFrame returns the unmasked Close frame a server sends with the given
+// code and reason.
+func closeFrame(code int, reason string) []byte {
+	return wstest.BuildFrame(true, opCodeClose, false, [4]byte{}, append([]byte{byte(code >> 8), byte(code)}, reason...))
+}
+
+// isCloseError reports whether err is a *CloseError with the given code
+// and reason.
+func isCloseError(err error, code int, reason string) bool {
+	closeErr, ok := err.(*CloseError)
+
+	return ok && closeErr.Code == code && closeErr.Text == reason
+}
+
+func TestCloseDefaultCode(t *testing.T) {
+	tests := []struct {
+		name string
+		code int
+		want int
+	}{
+		{"default", 0, CloseNormalClosure},
+		{"going away", CloseGoingAway, CloseGoingAway},
+	}
+
+	for _, tt := range tests {
+		out := new(bytes.Buffer)
+		c := newTestConn(bytes.NewReader(nil), out)
+
+		if err := c.SetDefaultCloseCode(tt.code); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Close(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		if want := closeFrame(tt.want, ""); !bytes.Equal(out.Bytes(), want) {
+			t.Fatalf("%s: Close wrote %x, want %x", tt.name, out.Bytes(), want)
+		}
+
+		// The connection is closed, so closing it again sends nothing.
+		out.Reset()
+		c.Close()
+
+		if out.Len() != 0 {
+			t.Fatalf("%s: closing again wrote %x", tt.name, out.Bytes())
+		}
+	}
+}
+
+func TestUpgraderDefaultCloseCode(t *testing.T) {
+	url := newTestServer(t, &Upgrader{DefaultCloseCode: CloseGoingAway}, func(conn Conn) {})
+	conn, err := Dial(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	if _, _, err := conn.ReadMessage(); !isCloseError(err, CloseGoingAway, "") {
+		t.Fatalf("got %v, want a *CloseError with code %d", err, CloseGoingAway)
+	}
+}
+
+func TestCloseWithCode(t *testing.T) {
+	out := new(bytes.Buffer)
+	c := newTestConn(bytes.NewReader(nil), out)
+
+	for _, code := range []int{0, 999, CloseNoStatusReceived, 1006, 1015, 5000} {
+		if err := c.CloseWithCode(code, ""); err != ErrInvalidCloseCode {
+			t.Fatalf("CloseWithCode(%d) returned %v, want ErrInvalidCloseCode", code, err)
+		}
+
+		if err := c.CloseGracefully(context.Background(), code, ""); err != ErrInvalidCloseCode {
+			t.Fatalf("CloseGracefully(%d) returned %v, want ErrInvalidCloseCode", code, err)
+		}
+	}
+
+	if err := c.CloseWithCode(CloseNormalClosure, strings.Repeat("x", 200)); err != ErrCloseReasonTooLong {
+		t.Fatalf("got %v for a 200 byte reason, want ErrCloseReasonTooLong", err)
+	}
+
+	if out.Len() != 0 || !c.IsAlive() {
+		t.Fatalf("rejected closes wrote %x or closed the connection", out.Bytes())
+	}
+
+	if err := c.CloseWithCode(CloseNormalClosure, "bye"); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []byte{0x88, 0x05, 0x03, 0xe8, 'b', 'y', 'e'}; !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("wrote %x, want %x", out.Bytes(), want)
+	}
+}
+
+func TestCloseWithCodeTruncatedReason(t *testing.T) {
+	out := new(bytes.Buffer)
+	c := newTestConn(bytes.NewReader(nil), out)
+	c.SetTruncateCloseReason(true)
+
+	if err := c.CloseWithCode(CloseGoingAway, strings.Repeat("x", 200)); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := closeFrame(CloseGoingAway, strings.Repeat("x", maxCloseReasonLength)); !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("wrote %x, want %x", out.Bytes(), want)
+	}
+}
+
+func TestWaitCloseError(t *testing.T) {
+	in := wstest.BuildFrame(true, opCodeClose, true, testMask, []byte{0x0F, 0xA0, 'b', 'y', 'e'})
+	c := newTestConn(bytes.NewReader(in), io.Discard)
+
+	waited := make(chan error, 1)
+
+	go func() { waited <- c.Wait() }()
+
+	if _, _, err := c.ReadMessage(); !isCloseError(err, 4000, "bye") {
+		t.Fatalf("read got %v, want the peer's close", err)
+	}
+
+	if err := <-waited; !isCloseError(err, 4000, "bye") {
+		t.Fatalf("Wait returned %v, want a *CloseError with code 4000", err)
+	}
+
+	// A connection closed by the application has no error to report.
+	c = newTestConn(bytes.NewReader(nil), io.Discard)
+	c.Close()
+
+	if err := c.Wait(); err != nil {
+		t.Fatalf("Wait returned %v after Close, want nil", err)
+	}
+}
+
+func TestTruncateCloseReason(t *testing.T) {
+	tests := []struct {
+		reason string
+		want   string
+	}{
+		{strings.Repeat("é", 100), strings.Repeat("é", 61)},
+		{"a" + strings.Repeat("€", 50), "a" + strings.Repeat("€", 40)},
+		{strings.Repeat("€", 41), strings.Repeat("€", 41)},
+		{"short", "short"},
+	}
+
+	for _, tt := range tests {
+		out := new(bytes.Buffer)
+		c := newTestConn(bytes.NewReader(nil), out)
+		c.SetTruncateCloseReason(true)
+
+		if err := c.CloseWithCode(CloseNormalClosure, tt.reason); err != nil {
+			t.Fatal(err)
+		}
+
+		_, reason := parseClosePayload(out.Bytes()[2:])
+
+		if len(reason) > maxCloseReasonLength || !utf8.ValidString(reason) || reason != tt.want {
+			t.Fatalf("reason of %d bytes truncated to %q, want %q", len(tt.reason), reason, tt.want)
+		}
+	}
+
+	// Without truncation the reason is rejected and nothing is sent.
+	out := new(bytes.Buffer)
+	c := newTestConn(bytes.NewReader(nil), out)
+
+	if err := c.CloseWithCode(CloseNormalClosure, strings.Repeat("é", 100)); err != ErrCloseReasonTooLong || out.Len() != 0 {
+		t.Fatalf("got %v and wrote %x, want ErrCloseReasonTooLong", err, out.Bytes())
+	}
+}
+
+func TestCloseGracefully(t *testing.T) {
+	closed := make(chan error, 1)
+
+	url := newTestServer(t, &Upgrader{}, func(conn Conn) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		closed <- conn.CloseGracefully(ctx, CloseGoingAway, "restart")
+	})
+
+	conn, err := Dial(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	// Reading the Close frame echoes it.
+	if _, _, err := conn.ReadMessage(); !isCloseError(err, CloseGoingAway, "restart") {
+		t.Fatalf("client got %v, want the server's close", err)
+	}
+
+	if err := <-closed; !isCloseError(err, CloseGoingAway, "") {
+		t.Fatalf("CloseGracefully returned %v, want the echoed close", err)
+	}
+}
+
+func TestCloseGracefullySilentPeer(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+
+	closed := make(chan error, 1)
+
+	url := newTestServer(t, &Upgrader{}, func(conn Conn) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		start := time.Now()
+		err := conn.CloseGracefully(ctx, CloseNormalClosure, "")
+
+		if elapsed := time.Since(start); elapsed < timeout {
+			err = fmt.Errorf("returned %v after %v, before the deadline", err, elapsed)
+		}
+
+		closed <- err
+	})
+
+	// The peer completes the handshake and then never answers.
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "ws://"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	if err := newHandshakeRequest().Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-closed; err != context.DeadlineExceeded {
+		t.Fatalf("CloseGracefully returned %v, want context.DeadlineExceeded", err)
+	}
+}
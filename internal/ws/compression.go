@@ -0,0 +1,213 @@
+package ws
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"math"
+	"strings"
+	"sync"
+)
+
+const defaultCompressionThreshold = 256
+
+// deflateTail is appended to a compressed payload before inflating it. The
+// first four bytes are the empty stored block stripped by the sender as per
+// section 7.2.1 of RFC 7692, the rest is a final empty stored block so the
+// decompressor sees a properly terminated stream.
+const deflateTail = "\x00\x00\xff\xff\x01\x00\x00\xff\xff"
+
+// deflateResponse is the permessage-deflate configuration accepted by the
+// server. Context takeover is disabled in both directions so every message
+// is compressed independently and no compressor state is kept around.
+const deflateResponse = "permessage-deflate; server_no_context_takeover; client_no_context_takeover"
+
+// Extension is a single entry of a Sec-WebSocket-Extensions header.
+type Extension struct {
+	// Name is the extension token, e.g. permessage-deflate.
+	Name string
+	// Params maps the name of every parameter to its value, which is empty
+	// for parameters without one.
+	Params map[string]string
+}
+
+// parseExtensions parses the values of the Sec-WebSocket-Extensions header
+// as described in section 9.1 of RFC 6455.
+func parseExtensions(values []string) []Extension {
+	extensions := make([]Extension, 0)
+
+	for _, value := range values {
+		for _, offer := range strings.Split(value, ",") {
+			parts := strings.Split(offer, ";")
+			name := strings.TrimSpace(parts[0])
+
+			if name == "" {
+				continue
+			}
+
+			ext := Extension{Name: name, Params: make(map[string]string)}
+
+			for _, param := range parts[1:] {
+				key, value, _ := strings.Cut(param, "=")
+				key = strings.TrimSpace(key)
+
+				if key == "" {
+					continue
+				}
+
+				ext.Params[key] = strings.Trim(strings.TrimSpace(value), `"`)
+			}
+
+			extensions = append(extensions, ext)
+		}
+	}
+
+	return extensions
+}
+
+// hasExtension reports whether an extension with the given name is listed.
+func hasExtension(extensions []Extension, name string) bool {
+	for _, ext := range extensions {
+		if ext.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// negotiateDeflate reports whether one of the offered extensions is a
+// permessage-deflate configuration the server can accept.
+func negotiateDeflate(offers []Extension) bool {
+	for _, offer := range offers {
+		if offer.Name != "permessage-deflate" {
+			continue
+		}
+
+		if acceptsDeflateParams(offer.Params) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// acceptsDeflateParams reports whether the server can honor all the
+// parameters of a permessage-deflate offer. The compressor always uses
+// the maximum window size, so offers restricting it are declined.
+func acceptsDeflateParams(params map[string]string) bool {
+	for key, value := range params {
+		switch key {
+		case "server_no_context_takeover", "client_no_context_takeover", "client_max_window_bits":
+		case "server_max_window_bits":
+			if value != "15" {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// flateWriterPool and flateReaderPool share compressors and decompressors
+// between all connections. Context takeover is never negotiated, so none
+// of them carries state from one message to the next and each is only
+// held while a message is being processed, which bounds their memory by
+// the number of messages in flight rather than of connections.
+var (
+	flateWriterPool sync.Pool
+	flateReaderPool sync.Pool
+)
+
+// compressPayload compresses p with DEFLATE and strips the trailing empty
+// stored block, as required by section 7.2.1 of RFC 7692.
+func compressPayload(p []byte) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+
+	fw, ok := flateWriterPool.Get().(*flate.Writer)
+
+	if ok {
+		fw.Reset(buffer)
+	} else {
+		var err error
+
+		fw, err = flate.NewWriter(buffer, flate.DefaultCompression)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	defer flateWriterPool.Put(fw)
+
+	if _, err := fw.Write(p); err != nil {
+		return nil, err
+	}
+
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buffer.Bytes(), []byte(deflateTail[:4])), nil
+}
+
+// deflatedTooLarge reports whether size bytes of compressed data are more
+// than any message inflating to at most limit bytes can take, so that the
+// fragments of a compressed message are not collected past the read limit
+// before inflating them. Incompressible data is stored in blocks of up to
+// 65535 bytes with a 5 byte header, a compressed message is never larger.
+// Zero means no limit.
+func deflatedTooLarge(size int, limit int64) bool {
+	return limit > 0 && int64(size) > limit+(limit/65535+2)*5
+}
+
+// decompressPayload inflates a payload compressed with compressPayload.
+// Inflating stops with ErrMessageTooLarge as soon as the output exceeds
+// limit, or with ErrDecompressionRatio once it exceeds maxRatio times the
+// size of p, so a small payload crafted to inflate to a huge size cannot
+// exhaust memory. A zero limit means defaultReadLimit and a zero maxRatio
+// means no ratio limit.
+func decompressPayload(p []byte, limit int64, maxRatio int) ([]byte, error) {
+	src := io.MultiReader(bytes.NewReader(p), strings.NewReader(deflateTail))
+	fr, ok := flateReaderPool.Get().(io.ReadCloser)
+
+	if ok {
+		fr.(flate.Resetter).Reset(src, nil)
+	} else {
+		fr = flate.NewReader(src)
+	}
+
+	defer flateReaderPool.Put(fr)
+
+	tooLarge := ErrMessageTooLarge
+
+	if limit <= 0 {
+		limit = defaultReadLimit
+	}
+
+	if maxRatio > 0 {
+		ratioLimit := int64(math.MaxInt64)
+
+		if int64(len(p)) < math.MaxInt64/int64(maxRatio) {
+			ratioLimit = int64(len(p)) * int64(maxRatio)
+		}
+
+		if ratioLimit < limit {
+			limit, tooLarge = ratioLimit, ErrDecompressionRatio
+		}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(fr, limit+1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > limit {
+		return nil, tooLarge
+	}
+
+	return data, nil
+}
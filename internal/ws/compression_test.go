@@ -0,0 +1,440 @@
+package ws
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"maps"
+	"net/http"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/asynched/golang-websocket-impl/internal/wstest"
+)
+
+func TestCompressionThreshold(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int
+		size      int
+		rsv1      bool
+	}{
+		{"below the default", 0, defaultCompressionThreshold - 1, false},
+		{"at the default", 0, defaultCompressionThreshold, true},
+		{"below a custom threshold", 1024, 1000, false},
+		{"above a custom threshold", 16, 100, true},
+	}
+
+	for _, tt := range tests {
+		out := new(bytes.Buffer)
+		c := newTestConn(bytes.NewReader(nil), out)
+		c.compress = true
+		c.compressionThreshold = defaultCompressionThreshold
+
+		if tt.threshold != 0 {
+			c.SetCompressionThreshold(tt.threshold)
+		}
+
+		data := bytes.Repeat([]byte("a"), tt.size)
+
+		if err := c.WriteMessage(BinaryMessage, data); err != nil {
+			t.Fatal(err)
+		}
+
+		if rsv1 := out.Bytes()[0]&rsv1Bit != 0; rsv1 != tt.rsv1 {
+			t.Fatalf("%s: RSV1 is %v, want %v", tt.name, rsv1, tt.rsv1)
+		}
+
+		// The message reads back the same either way, on the client side
+		// as the frame is unmasked.
+		r := newTestConn(bytes.NewReader(out.Bytes()), new(bytes.Buffer))
+		r.compress = true
+		r.isClient = true
+
+		if _, got, err := r.ReadMessage(); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: read back %d bytes and %v", tt.name, len(got), err)
+		}
+	}
+}
+
+func TestControlFramesNeverCompressed(t *testing.T) {
+	out := new(bytes.Buffer)
+	c := newTestConn(bytes.NewReader(nil), out)
+	c.compress = true
+	c.SetCompressionThreshold(1)
+
+	if err := c.PingWithData(bytes.Repeat([]byte("p"), 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Pong(bytes.Repeat([]byte("p"), 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.CloseWithCode(CloseNormalClosure, strings.Repeat("r", 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	for b := out.Bytes(); len(b) > 0; b = b[2+int(b[1]):] {
+		if b[0]&rsv1Bit != 0 {
+			t.Fatalf("control frame with opcode %#x sent with RSV1 set", b[0]&0x0F)
+		}
+	}
+}
+
+func TestReadCompressedControlFrame(t *testing.T) {
+	for _, opCode := range []byte{opCodePing, opCodePong, opCodeClose} {
+		in := wstest.BuildFrame(true, opCode, true, testMask, nil)
+		in[0] |= rsv1Bit
+
+		// The frame is rejected whether or not compression was negotiated.
+		for _, compress := range []bool{false, true} {
+			out := new(bytes.Buffer)
+			c := newTestConn(bytes.NewReader(in), out)
+			c.compress = compress
+
+			if _, _, err := c.ReadMessage(); err != ErrCompressedControlFrame {
+				t.Fatalf("opcode %#x, compression %v: got %v, want ErrCompressedControlFrame", opCode, compress, err)
+			}
+
+			if want := closeFrame(CloseProtocolError, ""); !bytes.Equal(out.Bytes(), want) {
+				t.Fatalf("opcode %#x, compression %v: wrote %x, want %x", opCode, compress, out.Bytes(), want)
+			}
+		}
+	}
+}
+
+func TestReadReservedBits(t *testing.T) {
+	// withRSV returns a masked frame with the given reserved bits set.
+	withRSV := func(rsv byte, fin bool, opCode byte, payload []byte) []byte {
+		frame := wstest.BuildFrame(fin, opCode, true, testMask, payload)
+		frame[0] |= rsv
+
+		return frame
+	}
+
+	tests := []struct {
+		name     string
+		compress bool
+		in       []byte
+		want     error
+	}{
+		{"RSV1 without compression", false, withRSV(rsv1Bit, true, opCodeText, []byte("x")), ErrReservedBits},
+		{"RSV2", true, withRSV(0x20, true, opCodeText, []byte("x")), ErrReservedBits},
+		{"RSV3", true, withRSV(0x10, true, opCodeText, []byte("x")), ErrReservedBits},
+		{
+			"RSV1 on a continuation",
+			true,
+			append(
+				wstest.BuildFrame(false, opCodeText, true, testMask, []byte("x")),
+				withRSV(rsv1Bit, true, opCodeContinuation, []byte("y"))...,
+			),
+			ErrCompressedContinuation,
+		},
+	}
+
+	for _, tt := range tests {
+		out := new(bytes.Buffer)
+		c := newTestConn(bytes.NewReader(tt.in), out)
+		c.compress = tt.compress
+
+		if _, _, err := c.ReadMessage(); err != tt.want {
+			t.Fatalf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+
+		if want := closeFrame(CloseProtocolError, ""); !bytes.Equal(out.Bytes(), want) {
+			t.Fatalf("%s: wrote %x, want %x", tt.name, out.Bytes(), want)
+		}
+	}
+}
+
+func TestCompressionEnabled(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		offered string
+		want    bool
+	}{
+		{"offered and enabled", true, "permessage-deflate", true},
+		{"not offered", true, "", false},
+		{"other extension offered", true, "x-custom", false},
+		{"offered but disabled", false, "permessage-deflate", false},
+	}
+
+	for _, tt := range tests {
+		compressed := make(chan bool, 1)
+
+		url := newTestServer(t, &Upgrader{EnableCompression: tt.enabled}, func(conn Conn) {
+			compressed <- conn.CompressionEnabled()
+		})
+
+		header := http.Header{}
+
+		if tt.offered != "" {
+			header.Set("Sec-WebSocket-Extensions", tt.offered)
+		}
+
+		if resp := doHandshake(t, url, header); resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("%s: got status %s", tt.name, resp.Status)
+		}
+
+		if got := <-compressed; got != tt.want {
+			t.Fatalf("%s: CompressionEnabled is %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// The client side reports what the server accepted.
+	c := newTestConn(bytes.NewReader(nil), io.Discard)
+
+	if c.CompressionEnabled() {
+		t.Fatal("CompressionEnabled is true without negotiation")
+	}
+}
+
+func TestReadDeflateBomb(t *testing.T) {
+	const readLimit = 1 << 20
+
+	// 64 MiB of zeros deflate to about 64 KiB.
+	bomb, err := compressPayload(make([]byte, 64<<20))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := wstest.BuildFrame(true, opCodeBinary, true, testMask, bomb)
+	in[0] |= rsv1Bit
+
+	out := new(bytes.Buffer)
+	c := newTestConn(bytes.NewReader(in), out)
+	c.compress = true
+	c.SetReadLimit(readLimit)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	_, _, err = c.ReadMessage()
+
+	runtime.ReadMemStats(&after)
+
+	if err != ErrMessageTooLarge {
+		t.Fatalf("got %v, want ErrMessageTooLarge", err)
+	}
+
+	if want := closeFrame(CloseMessageTooBig, ""); !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("wrote %x, want %x", out.Bytes(), want)
+	}
+
+	// Inflating stops right past the read limit instead of expanding the
+	// whole message.
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16*readLimit {
+		t.Fatalf("allocated %d bytes reading a bomb with a %d byte limit", allocated, readLimit)
+	}
+}
+
+func TestParseExtensions(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   []Extension
+	}{
+		{
+			[]string{"permessage-deflate; client_max_window_bits=10"},
+			[]Extension{{"permessage-deflate", map[string]string{"client_max_window_bits": "10"}}},
+		},
+		{
+			[]string{`permessage-deflate;client_no_context_takeover; server_max_window_bits="15", x-custom`},
+			[]Extension{
+				{"permessage-deflate", map[string]string{"client_no_context_takeover": "", "server_max_window_bits": "15"}},
+				{"x-custom", map[string]string{}},
+			},
+		},
+		{
+			[]string{"a", " , b ;", ""},
+			[]Extension{{"a", map[string]string{}}, {"b", map[string]string{}}},
+		},
+	}
+
+	for _, tt := range tests {
+		got := parseExtensions(tt.values)
+
+		if !slices.EqualFunc(got, tt.want, func(a, b Extension) bool {
+			return a.Name == b.Name && maps.Equal(a.Params, b.Params)
+		}) {
+			t.Fatalf("parseExtensions(%q) = %v, want %v", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiatedExtensions(t *testing.T) {
+	negotiated := make(chan []Extension, 1)
+
+	url := newTestServer(t, &Upgrader{EnableCompression: true}, func(conn Conn) {
+		negotiated <- conn.NegotiatedExtensions()
+	})
+
+	doHandshake(t, url, http.Header{"Sec-WebSocket-Extensions": {"permessage-deflate; client_max_window_bits=10"}})
+
+	extensions := <-negotiated
+
+	if len(extensions) != 1 || extensions[0].Name != "permessage-deflate" {
+		t.Fatalf("negotiated %v, want permessage-deflate", extensions)
+	}
+
+	if _, ok := extensions[0].Params["server_no_context_takeover"]; !ok {
+		t.Fatalf("negotiated %v without server_no_context_takeover", extensions)
+	}
+}
+
+func TestLastMessageCompressed(t *testing.T) {
+	deflated, err := compressPayload([]byte("compressed"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compressed := wstest.BuildFrame(true, opCodeText, true, testMask, deflated)
+	compressed[0] |= rsv1Bit
+
+	in := append(compressed, wstest.BuildFrame(true, opCodeText, true, testMask, []byte("plain"))...)
+	c := newTestConn(bytes.NewReader(in), io.Discard)
+	c.compress = true
+
+	if c.LastMessageCompressed() {
+		t.Fatal("LastMessageCompressed is true before any message was read")
+	}
+
+	for _, want := range []struct {
+		data       string
+		compressed bool
+	}{{"compressed", true}, {"plain", false}} {
+		_, data, err := c.ReadMessage()
+
+		if err != nil || string(data) != want.data {
+			t.Fatalf("got %q and %v, want %q", data, err, want.data)
+		}
+
+		if got := c.LastMessageCompressed(); got != want.compressed {
+			t.Fatalf("LastMessageCompressed is %v after reading %q", got, data)
+		}
+	}
+}
+
+func TestMaxDecompressionRatio(t *testing.T) {
+	const ratio = 10
+
+	// 1 MiB of zeros deflates to about 1 KiB, far past the ratio.
+	bomb, err := compressPayload(make([]byte, 1<<20))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text := []byte("a message compressing to about half of its size, well within the ratio")
+	deflated, err := compressPayload(text)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := func(payload []byte) []byte {
+		f := wstest.BuildFrame(true, opCodeBinary, true, testMask, payload)
+		f[0] |= rsv1Bit
+
+		return f
+	}
+
+	out := new(bytes.Buffer)
+	c := newTestConn(bytes.NewReader(append(frame(deflated), frame(bomb)...)), out)
+	c.compress = true
+	c.maxDecompressionRatio = ratio
+
+	if _, data, err := c.ReadMessage(); err != nil || !bytes.Equal(data, text) {
+		t.Fatalf("got %q and %v, want the message within the ratio", data, err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	_, _, err = c.ReadMessage()
+
+	runtime.ReadMemStats(&after)
+
+	if err != ErrDecompressionRatio {
+		t.Fatalf("got %v, want ErrDecompressionRatio", err)
+	}
+
+	if want := closeFrame(CloseMessageTooBig, ""); !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("wrote %x, want %x", out.Bytes(), want)
+	}
+
+	// Inflating stops once the output reaches the ratio, long before the
+	// whole message.
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 256<<10 {
+		t.Fatalf("allocated %d bytes inflating past the ratio", allocated)
+	}
+}
+
+func TestCompressorPooling(t *testing.T) {
+	const conns = 100
+
+	data := bytes.Repeat([]byte("pooled compressor "), 64)
+	c := make([]*connImpl, conns)
+
+	for i := range c {
+		c[i] = newTestConn(bytes.NewReader(nil), io.Discard)
+		c[i].compress = true
+		c[i].compressionThreshold = defaultCompressionThreshold
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	if _, err := flate.NewWriter(io.Discard, flate.DefaultCompression); err != nil {
+		t.Fatal(err)
+	}
+
+	runtime.ReadMemStats(&after)
+	writerSize := after.TotalAlloc - before.TotalAlloc
+
+	// Warm up the pool, then measure a message sent by every connection.
+	c[0].WriteMessage(TextMessage, data)
+
+	runtime.ReadMemStats(&before)
+
+	for i := range c {
+		if err := c[i].WriteMessage(TextMessage, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runtime.ReadMemStats(&after)
+
+	// Allocating a compressor per connection would take conns times
+	// writerSize. The margin covers the race detector randomly dropping
+	// pooled items.
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > conns*writerSize/2 {
+		t.Fatalf("%d connections allocated %d bytes compressing a message each, a compressor takes %d", conns, allocated, writerSize)
+	}
+}
+
+func BenchmarkCompressManyConns(b *testing.B) {
+	const conns = 100
+
+	data := bytes.Repeat([]byte("pooled compressor "), 64)
+	c := make([]*connImpl, conns)
+
+	for i := range c {
+		c[i] = newTestConn(bytes.NewReader(nil), io.Discard)
+		c[i].compress = true
+		c[i].compressionThreshold = defaultCompressionThreshold
+	}
+
+	b.ReportAllocs()
+
+	for i := range b.N {
+		if err := c[i%conns].WriteMessage(TextMessage, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package ws
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ErrTooManyConnections is returned by Upgrade when the client IP already
+// has Upgrader.MaxConnectionsPerIP connections open.
+var ErrTooManyConnections = errors.New("too many connections from this address")
+
+// clientIP returns the address of the client that sent r.
+func (u *Upgrader) clientIP(r *http.Request) string {
+	if u.TrustForwardedHeaders {
+		// Proxies append the address they received the request from, so
+		// only the last entry was set by the trusted proxy, the ones before
+		// it come from the client.
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			forwarded := values[len(values)-1]
+
+			if i := strings.LastIndexByte(forwarded, ','); i >= 0 {
+				forwarded = forwarded[i+1:]
+			}
+
+			if last := strings.TrimSpace(forwarded); last != "" {
+				return last
+			}
+		}
+
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			return strings.TrimSpace(realIP)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// acquireIP registers a connection from ip, reporting false if it would
+// exceed MaxConnectionsPerIP. The returned function releases it.
+func (u *Upgrader) acquireIP(ip string) (func(), bool) {
+	if u.MaxConnectionsPerIP <= 0 {
+		return func() {}, true
+	}
+
+	u.ipMu.Lock()
+	defer u.ipMu.Unlock()
+
+	if u.connsPerIP[ip] >= u.MaxConnectionsPerIP {
+		return nil, false
+	}
+
+	if u.connsPerIP == nil {
+		u.connsPerIP = make(map[string]int)
+	}
+
+	u.connsPerIP[ip]++
+
+	return func() {
+		u.ipMu.Lock()
+		defer u.ipMu.Unlock()
+
+		// Entries are removed once unused so the map does not grow with
+		// every address ever seen.
+		if u.connsPerIP[ip]--; u.connsPerIP[ip] <= 0 {
+			delete(u.connsPerIP, ip)
+		}
+	}, true
+}
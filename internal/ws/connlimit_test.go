@@ -0,0 +1,77 @@
+package ws
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	const limit = 2
+
+	u := &Upgrader{MaxConnectionsPerIP: limit}
+	url := newTestServer(t, u, echo)
+
+	var conns []Conn
+
+	for range limit {
+		conn, err := Dial(url)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer conn.Close()
+
+		conns = append(conns, conn)
+	}
+
+	if _, err := Dial(url); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("got %v for a connection over the limit, want a 503 response", err)
+	}
+
+	// Closing a connection makes room for a new one.
+	conns[0].Close()
+
+	for deadline := time.Now().Add(5 * time.Second); u.ActiveConnections() == limit; {
+		if time.Now().After(deadline) {
+			t.Fatal("server connection still open after the client closed it")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	conn, err := Dial(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Close()
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		trust   bool
+		headers map[string]string
+		want    string
+	}{
+		{false, map[string]string{"X-Forwarded-For": "10.0.0.1"}, "192.0.2.1"},
+		{true, nil, "192.0.2.1"},
+		{true, map[string]string{"X-Forwarded-For": "10.0.0.1, 10.0.0.2"}, "10.0.0.2"},
+		{true, map[string]string{"X-Real-IP": " 10.0.0.3 "}, "10.0.0.3"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+
+		for key, value := range tt.headers {
+			r.Header.Set(key, value)
+		}
+
+		if got := (&Upgrader{TrustForwardedHeaders: tt.trust}).clientIP(r); got != tt.want {
+			t.Fatalf("trusting headers %v %v: got %s, want %s", tt.trust, tt.headers, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package ws
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Dialer holds the options used to open a client websocket connection.
+// The zero value is a valid Dialer using the default options.
+type Dialer struct {
+	// NetDialContext opens the underlying connection. Defaults to the
+	// DialContext method of a zero net.Dialer.
+	NetDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// TLSClientConfig is used for wss:// URLs. When nil, the default
+	// configuration is used with the server name taken from the URL.
+	TLSClientConfig *tls.Config
+	// ReadBufferSize is the initial size in bytes of the read buffer,
+	// see Upgrader.ReadBufferSize. Defaults to 4096 bytes.
+	ReadBufferSize int
+	// Subprotocols lists the subprotocols offered to the server in order of
+	// preference. The one selected by the server is reported by
+	// Conn.Subprotocol.
+	Subprotocols []string
+	// Hooks are invoked as dialed connections are used, see Hooks.
+	Hooks *Hooks
+	// Key pins the Sec-WebSocket-Key sent in the opening handshake instead
+	// of generating a random one. It is meant for tests that compare the
+	// handshake against fixed bytes only: reusing keys defeats their purpose.
+	Key string
+	// Header holds additional headers sent with the handshake request, such
+	// as Authorization or Cookie. They cannot override the headers set by
+	// the Dialer itself, subprotocols are offered with Subprotocols. Note
+	// that over ws:// they are sent in the clear, use wss:// for
+	// credentials.
+	Header http.Header
+	// HandshakeTimeout bounds the whole connection setup, from opening the
+	// underlying connection to reading the handshake response. A dial that
+	// takes longer fails with a net.Error whose Timeout method reports true.
+	// Zero means no timeout besides the one of the context.
+	HandshakeTimeout time.Duration
+}
+
+var defaultDialer = &Dialer{}
+
+// Dial opens a client websocket connection to the given ws:// or wss:// URL.
+// It is a shorthand for calling DialContext on a zero Dialer.
+func Dial(urlStr string) (Conn, error) {
+	return defaultDialer.DialContext(context.Background(), urlStr)
+}
+
+// DialContext opens a client websocket connection to the given ws:// or
+// wss:// URL. The context bounds the connection setup and the opening
+// handshake, it has no effect on the returned connection.
+func (d *Dialer) DialContext(ctx context.Context, urlStr string) (Conn, error) {
+	if d.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, d.HandshakeTimeout)
+		defer cancel()
+	}
+
+	u, err := url.Parse(urlStr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var port string
+
+	switch u.Scheme {
+	case "ws":
+		port = "80"
+	case "wss":
+		port = "443"
+	default:
+		return nil, errors.New("invalid url scheme, expected 'ws' or 'wss'")
+	}
+
+	addr := u.Host
+
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	netDial := d.NetDialContext
+
+	if netDial == nil {
+		netDial = (&net.Dialer{}).DialContext
+	}
+
+	conn, err := netDial(ctx, "tcp", addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "wss" {
+		config := d.TLSClientConfig
+
+		if config == nil {
+			config = &tls.Config{}
+		}
+
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName = u.Hostname()
+		}
+
+		tlsConn := tls.Client(conn, config)
+
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		conn = tlsConn
+	}
+
+	c, err := d.handshake(ctx, conn, u)
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// handshake performs the client side of the opening handshake described
+// in section 4.1 of RFC 6455 over conn, giving up once ctx is done.
+func (d *Dialer) handshake(ctx context.Context, conn net.Conn, u *url.URL) (*connImpl, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// Cancelling ctx expires the deadline of conn, which interrupts the
+	// request being written or the response being read.
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	c, err := d.exchangeHandshake(conn, u)
+
+	if !stop() {
+		return nil, ctx.Err()
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return c, err
+}
+
+// exchangeHandshake sends the handshake request over conn and validates
+// the response of the server.
+func (d *Dialer) exchangeHandshake(conn net.Conn, u *url.URL) (*connImpl, error) {
+	key := d.Key
+
+	if key == "" {
+		var err error
+
+		key, err = generateKey()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+
+	for key, values := range d.Header {
+		if !isHandshakeHeader(key) {
+			req.Header[http.CanonicalHeaderKey(key)] = slices.Clone(values)
+		}
+	}
+
+	req.Header["Upgrade"] = []string{"websocket"}
+	req.Header["Connection"] = []string{"Upgrade"}
+	req.Header["Sec-WebSocket-Key"] = []string{key}
+	req.Header["Sec-WebSocket-Version"] = []string{"13"}
+
+	if len(d.Subprotocols) > 0 {
+		req.Header["Sec-WebSocket-Protocol"] = []string{strings.Join(d.Subprotocols, ", ")}
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(br, req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, errors.New("unexpected handshake response status: " + resp.Status)
+	}
+
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		return nil, errors.New("missing 'upgrade' header")
+	}
+
+	if !strings.EqualFold(resp.Header.Get("Connection"), "upgrade") {
+		return nil, errors.New("missing 'connection' header")
+	}
+
+	if resp.Header.Get("Sec-WebSocket-Accept") != hashKey(key) {
+		return nil, errors.New("invalid 'sec-websocket-accept' header")
+	}
+
+	subprotocol := resp.Header.Get("Sec-WebSocket-Protocol")
+
+	if subprotocol != "" && !slices.Contains(d.Subprotocols, subprotocol) {
+		return nil, errors.New("server selected a subprotocol that was not offered")
+	}
+
+	readBufferSize := d.ReadBufferSize
+
+	if readBufferSize <= 0 {
+		readBufferSize = defaultReadBufferSize
+	}
+
+	out := &fullWriter{w: conn}
+
+	return &connImpl{
+		conn:           conn,
+		rw:             bufio.NewReadWriter(br, bufio.NewWriter(out)),
+		out:            out,
+		buffer:         nil,
+		readBuf:        make([]byte, readBufferSize),
+		readBufferSize: readBufferSize,
+		isClient:       true,
+		extensions:     resp.Header.Get("Sec-WebSocket-Extensions"),
+		subprotocol:    subprotocol,
+		hooks:          d.Hooks,
+		done:           make(chan struct{}),
+
+		compressionThreshold: defaultCompressionThreshold,
+		maxFragments:         defaultMaxFragments,
+		readLimit:            defaultReadLimit,
+	}, nil
+}
+
+// isHandshakeHeader reports whether key is one of the headers of the
+// handshake request set by the Dialer.
+func isHandshakeHeader(key string) bool {
+	for _, name := range []string{"Upgrade", "Connection", "Sec-WebSocket-Key", "Sec-WebSocket-Version", "Sec-WebSocket-Protocol", "Sec-WebSocket-Extensions"} {
+		if strings.EqualFold(key, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// generateKey returns a random base64 encoded 16 byte nonce to be used as
+// the Sec-WebSocket-Key of the opening handshake.
+func generateKey() (string, error) {
+	nonce := make([]byte, 16)
+
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(nonce), nil
+}
@@ -0,0 +1,180 @@
+package ws
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newRawServer starts a TCP server passing every connection to handle,
+// which is closed once handle returns, and returns its ws:// URL.
+func newRawServer(t *testing.T, handle func(conn net.Conn)) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				handle(conn)
+			}()
+		}
+	}()
+
+	return "ws://" + ln.Addr().String()
+}
+
+// acceptHandshake reads a handshake request from conn and answers it with
+// a 101 response carrying the given extra header lines.
+func acceptHandshake(conn net.Conn, extra string) {
+	r, err := http.ReadRequest(bufio.NewReader(conn))
+
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n%s\r\n", hashKey(r.Header.Get("Sec-WebSocket-Key")), extra)
+}
+
+func TestDialSubprotocol(t *testing.T) {
+	selected := make(chan string, 1)
+
+	url := newTestServer(t, &Upgrader{Subprotocols: []string{"b", "c"}}, func(conn Conn) {
+		selected <- conn.Subprotocol()
+	})
+
+	conn, err := (&Dialer{Subprotocols: []string{"a", "c"}}).DialContext(context.Background(), url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	if server, client := <-selected, conn.Subprotocol(); server != "c" || client != "c" {
+		t.Fatalf("server selected %q and client reports %q, want %q", server, client, "c")
+	}
+}
+
+func TestDialUnofferedSubprotocol(t *testing.T) {
+	url := newRawServer(t, func(conn net.Conn) {
+		acceptHandshake(conn, "Sec-WebSocket-Protocol: z\r\n")
+	})
+
+	if _, err := (&Dialer{Subprotocols: []string{"a"}}).DialContext(context.Background(), url); err == nil {
+		t.Fatal("dial succeeded with a subprotocol that was not offered")
+	}
+}
+
+func TestDialPinnedKey(t *testing.T) {
+	requests := make(chan string, 1)
+
+	url := newRawServer(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+
+		var request strings.Builder
+
+		for !strings.HasSuffix(request.String(), "\r\n\r\n") {
+			line, err := br.ReadString('\n')
+
+			if err != nil {
+				return
+			}
+
+			request.WriteString(line)
+		}
+
+		requests <- request.String()
+	})
+
+	d := &Dialer{
+		Key:          "dGhlIHNhbXBsZSBub25jZQ==",
+		Subprotocols: []string{"chat", "superchat"},
+	}
+
+	// The server hangs up without answering, failing the dial.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	d.DialContext(ctx, url+"/chat?room=1")
+
+	want := "GET /chat?room=1 HTTP/1.1\r\n" +
+		"Host: " + strings.TrimPrefix(url, "ws://") + "\r\n" +
+		"User-Agent: Go-http-client/1.1\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Protocol: chat, superchat\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Upgrade: websocket\r\n" +
+		"\r\n"
+
+	if got := <-requests; got != want {
+		t.Fatalf("sent request\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestDialHandshakeTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	// The server accepts the connection but never answers the handshake.
+	url := newRawServer(t, func(conn net.Conn) { <-release })
+
+	start := time.Now()
+	_, err := (&Dialer{HandshakeTimeout: 50 * time.Millisecond}).DialContext(context.Background(), url)
+
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("got %v, want a net.Error timeout", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("dial took %v to time out", elapsed)
+	}
+}
+
+func TestDialHeader(t *testing.T) {
+	authorization := make(chan string, 1)
+
+	u := &Upgrader{OnHandshakeRequest: func(r *http.Request) (any, error) {
+		authorization <- r.Header.Get("Authorization")
+		return nil, nil
+	}}
+
+	url := newTestServer(t, u, func(conn Conn) {})
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer token")
+	// Headers set by the Dialer itself are not overridden.
+	header.Set("Sec-WebSocket-Version", "8")
+
+	conn, err := (&Dialer{Header: header}).DialContext(context.Background(), url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	if got := <-authorization; got != "Bearer token" {
+		t.Fatalf("handler got Authorization %q, want %q", got, "Bearer token")
+	}
+}
@@ -0,0 +1,114 @@
+package ws
+
+import "sync/atomic"
+
+// Hooks holds optional callbacks invoked as a connection is used, so that
+// applications can collect metrics. Any of them may be nil. They are called
+// synchronously from the reading or writing goroutine and must not block.
+type Hooks struct {
+	// OnFrameRead is called for every frame read from the peer, with its
+	// opcode and payload length.
+	OnFrameRead func(opCode int, payloadLength int)
+	// OnFrameWrite is called for every frame written to the peer, with its
+	// opcode and payload length.
+	OnFrameWrite func(opCode int, payloadLength int)
+	// Logger receives diagnostic messages, such as the reason a connection
+	// was failed. It has the signature of log.Printf.
+	Logger func(format string, args ...any)
+	// OnHandshake is called by Upgrade once a handshake completed or
+	// failed, with the error message as the reason of a failure.
+	OnHandshake func(success bool, reason string)
+}
+
+func (h *Hooks) frameRead(opCode byte, payloadLength int) {
+	if h != nil && h.OnFrameRead != nil {
+		h.OnFrameRead(int(opCode), payloadLength)
+	}
+}
+
+func (h *Hooks) frameWrite(opCode byte, payloadLength int) {
+	if h != nil && h.OnFrameWrite != nil {
+		h.OnFrameWrite(int(opCode), payloadLength)
+	}
+}
+
+func (h *Hooks) handshake(err error) {
+	if h == nil || h.OnHandshake == nil {
+		return
+	}
+
+	if err != nil {
+		h.OnHandshake(false, err.Error())
+	} else {
+		h.OnHandshake(true, "")
+	}
+}
+
+func (h *Hooks) logf(format string, args ...any) {
+	if h != nil && h.Logger != nil {
+		h.Logger(format, args...)
+	}
+}
+
+// Stats counts frames by opcode and payload bytes in each direction using
+// atomic counters. Wire it to connections with the Hooks method, a single
+// Stats may be shared by any number of connections.
+type Stats struct {
+	framesRead    [16]atomic.Uint64
+	framesWritten [16]atomic.Uint64
+	bytesRead     atomic.Uint64
+	bytesWritten  atomic.Uint64
+}
+
+// FrameCounts holds the number of frames seen for each defined opcode.
+type FrameCounts struct {
+	Continuation uint64
+	Text         uint64
+	Binary       uint64
+	Close        uint64
+	Ping         uint64
+	Pong         uint64
+}
+
+// StatsSnapshot is a point in time copy of the counters of a Stats.
+type StatsSnapshot struct {
+	Read         FrameCounts
+	Written      FrameCounts
+	BytesRead    uint64
+	BytesWritten uint64
+}
+
+// Hooks returns hooks updating the counters of s.
+func (s *Stats) Hooks() *Hooks {
+	return &Hooks{
+		OnFrameRead: func(opCode int, payloadLength int) {
+			s.framesRead[opCode&0x0F].Add(1)
+			s.bytesRead.Add(uint64(payloadLength))
+		},
+		OnFrameWrite: func(opCode int, payloadLength int) {
+			s.framesWritten[opCode&0x0F].Add(1)
+			s.bytesWritten.Add(uint64(payloadLength))
+		},
+	}
+}
+
+// Snapshot returns the current value of the counters.
+func (s *Stats) Snapshot() StatsSnapshot {
+	return StatsSnapshot{
+		Read:         frameCounts(&s.framesRead),
+		Written:      frameCounts(&s.framesWritten),
+		BytesRead:    s.bytesRead.Load(),
+		BytesWritten: s.bytesWritten.Load(),
+	}
+}
+
+func frameCounts(counters *[16]atomic.Uint64) FrameCounts {
+	return FrameCounts{
+		Continuation: counters[opCodeContinuation].Load(),
+		Text:         counters[opCodeText].Load(),
+		Binary:       counters[opCodeBinary].Load(),
+		Close:        counters[opCodeClose].Load(),
+		Ping:         counters[opCodePing].Load(),
+		Pong:         counters[opCodePong].Load(),
+	}
+}
@@ -0,0 +1,102 @@
+package ws
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/asynched/golang-websocket-impl/internal/wstest"
+)
+
+func TestStatsSnapshot(t *testing.T) {
+	in := bytes.Join([][]byte{
+		wstest.BuildFrame(true, opCodeText, true, testMask, []byte("hello")),
+		wstest.BuildFrame(false, opCodeBinary, true, testMask, []byte("abc")),
+		wstest.BuildFrame(true, opCodePing, true, testMask, []byte("pi")),
+		wstest.BuildFrame(true, opCodeContinuation, true, testMask, []byte("defg")),
+		wstest.BuildFrame(true, opCodePong, true, testMask, []byte("p")),
+		wstest.BuildFrame(true, opCodeClose, true, testMask, []byte{0x03, 0xe8}),
+	}, nil)
+
+	var stats Stats
+
+	c := newTestConn(bytes.NewReader(in), io.Discard)
+	c.hooks = stats.Hooks()
+
+	for {
+		if _, _, err := c.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	want := StatsSnapshot{
+		Read:         FrameCounts{Continuation: 1, Text: 1, Binary: 1, Close: 1, Ping: 1, Pong: 1},
+		Written:      FrameCounts{Close: 1, Pong: 1},
+		BytesRead:    5 + 3 + 2 + 4 + 1 + 2,
+		BytesWritten: 2 + 2,
+	}
+
+	if got := stats.Snapshot(); got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestOnHandshake(t *testing.T) {
+	type result struct {
+		success bool
+		reason  string
+	}
+
+	results := make(chan result, 1)
+
+	u := &Upgrader{Hooks: &Hooks{OnHandshake: func(success bool, reason string) {
+		results <- result{success, reason}
+	}}}
+
+	r := newHandshakeRequest()
+	r.Header.Set("Sec-WebSocket-Version", "8")
+
+	u.Upgrade(httptest.NewRecorder(), r)
+
+	if got, want := <-results, (result{false, ErrUnsupportedVersion.Error()}); got != want {
+		t.Fatalf("OnHandshake got %+v, want %+v", got, want)
+	}
+
+	url := newTestServer(t, u, func(conn Conn) {})
+	doHandshake(t, url, nil)
+
+	if got, want := <-results, (result{true, ""}); got != want {
+		t.Fatalf("OnHandshake got %+v, want %+v", got, want)
+	}
+}
+
+func TestNamePrefixesLogger(t *testing.T) {
+	for _, name := range []string{"user-42", ""} {
+		var lines []string
+
+		in := wstest.BuildFrame(true, opCodeText, false, [4]byte{}, []byte("unmasked"))
+		c := newTestConn(bytes.NewReader(in), io.Discard)
+		c.hooks = &Hooks{Logger: func(format string, args ...any) {
+			lines = append(lines, fmt.Sprintf(format, args...))
+		}}
+		c.SetName(name)
+
+		if got := c.Name(); got != name {
+			t.Fatalf("Name returned %q, want %q", got, name)
+		}
+
+		c.ReadMessage()
+
+		want := "failing connection with code 1002: " + ErrUnmaskedFrame.Error()
+
+		if name != "" {
+			want = "[" + name + "] " + want
+		}
+
+		if len(lines) != 1 || lines[0] != want {
+			t.Fatalf("logged %q, want %q", lines, want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package ws
+
+import "sync"
+
+const defaultHubQueueSize = 16
+
+// Hub fans messages out to a set of registered connections. Each connection
+// has a bounded send queue drained by its own goroutine, so a broadcast
+// never waits on a slow consumer: connections whose queue is full, or whose
+// writes fail, are closed and evicted from the hub.
+// The zero value is an empty Hub ready to use.
+type Hub struct {
+	// QueueSize is the number of messages that can be pending for a single
+	// connection before it is considered too slow. Defaults to 16.
+	QueueSize int
+
+	mu      sync.Mutex
+	clients map[Conn]chan hubMessage
+}
+
+type hubMessage struct {
+	messageType int
+	data        []byte
+}
+
+// Register adds conn to the hub so it receives future broadcasts.
+func (h *Hub) Register(conn Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.clients == nil {
+		h.clients = make(map[Conn]chan hubMessage)
+	}
+
+	if _, ok := h.clients[conn]; ok {
+		return
+	}
+
+	queueSize := h.QueueSize
+
+	if queueSize <= 0 {
+		queueSize = defaultHubQueueSize
+	}
+
+	send := make(chan hubMessage, queueSize)
+	h.clients[conn] = send
+
+	go h.writePump(conn, send)
+}
+
+// Unregister removes conn from the hub without closing it.
+func (h *Hub) Unregister(conn Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if send, ok := h.clients[conn]; ok {
+		delete(h.clients, conn)
+		close(send)
+	}
+}
+
+// Len returns the number of registered connections.
+func (h *Hub) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.clients)
+}
+
+// Broadcast queues data to be written as a message of the given type to
+// every registered connection. The data is shared between connections and
+// must not be modified after calling Broadcast. It returns
+// ErrInvalidMessageType unless messageType is TextMessage or BinaryMessage.
+func (h *Hub) Broadcast(messageType int, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return ErrInvalidMessageType
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	msg := hubMessage{messageType: messageType, data: data}
+
+	for conn, send := range h.clients {
+		select {
+		case send <- msg:
+		default:
+			h.evictLocked(conn)
+		}
+	}
+
+	return nil
+}
+
+// writePump writes queued messages to conn until it is unregistered or a
+// write fails.
+func (h *Hub) writePump(conn Conn, send chan hubMessage) {
+	for msg := range send {
+		if err := conn.WriteMessage(msg.messageType, msg.data); err != nil {
+			h.mu.Lock()
+
+			if h.clients[conn] == send {
+				h.evictLocked(conn)
+			}
+
+			h.mu.Unlock()
+
+			return
+		}
+	}
+}
+
+// evictLocked removes conn from the hub and closes it.
+// It must be called with h.mu held.
+func (h *Hub) evictLocked(conn Conn) {
+	close(h.clients[conn])
+	delete(h.clients, conn)
+
+	// The writePump of a slow consumer may be blocked in a write, which
+	// holds the lock Close needs to send a Close frame. The underlying
+	// connection is closed directly instead, failing that write, and other
+	// implementations are closed without holding h.mu.
+	if c, ok := conn.(interface{ closeConn(error) error }); ok {
+		c.closeConn(nil)
+	} else {
+		go conn.Close()
+	}
+}
@@ -0,0 +1,78 @@
+package ws
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/asynched/golang-websocket-impl/internal/wstest"
+)
+
+// chanWriter sends a copy of everything written to it on a channel.
+type chanWriter chan []byte
+
+func (w chanWriter) Write(p []byte) (int, error) {
+	w <- bytes.Clone(p)
+
+	return len(p), nil
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestHubBroadcast(t *testing.T) {
+	const conns = 50
+
+	var h Hub
+
+	written := make(chanWriter, conns)
+
+	for range conns {
+		h.Register(newTestConn(bytes.NewReader(nil), written))
+	}
+
+	h.Register(newTestConn(bytes.NewReader(nil), failingWriter{}))
+
+	if err := h.Broadcast(TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := wstest.BuildFrame(true, opCodeText, false, [4]byte{}, []byte("hello"))
+
+	for i := range conns {
+		select {
+		case got := <-written:
+			if !bytes.Equal(got, want) {
+				t.Fatalf("connection wrote %x, want %x", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d connections received the broadcast", i, conns)
+		}
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); h.Len() != conns; {
+		if time.Now().After(deadline) {
+			t.Fatalf("hub holds %d connections, want %d once the failing one is evicted", h.Len(), conns)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHubBroadcastInvalidMessageType(t *testing.T) {
+	var h Hub
+
+	h.Register(newTestConn(bytes.NewReader(nil), io.Discard))
+
+	for _, messageType := range []int{0, opCodePing} {
+		if err := h.Broadcast(messageType, nil); err != ErrInvalidMessageType {
+			t.Fatalf("Broadcast(%d) returned %v, want ErrInvalidMessageType", messageType, err)
+		}
+	}
+}
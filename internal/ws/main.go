@@ -2,11 +2,25 @@ package ws
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"io"
+	"math"
 	"net"
 	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
 const (
@@ -20,50 +34,937 @@ const (
 	// 0xB - 0xF reserved
 )
 
+// Message types that can be passed to WriteMessage, they map to the
+// opcodes of the data frames carrying the message.
+const (
+	TextMessage   = opCodeText
+	BinaryMessage = opCodeBinary
+)
+
+// Close status codes as defined in section 7.4.1 of RFC 6455.
+const (
+	CloseNormalClosure           = 1000
+	CloseGoingAway               = 1001
+	CloseProtocolError           = 1002
+	CloseUnsupportedData         = 1003
+	CloseNoStatusReceived        = 1005
+	CloseAbnormalClosure         = 1006
+	CloseInvalidFramePayloadData = 1007
+	ClosePolicyViolation         = 1008
+	CloseMessageTooBig           = 1009
+	CloseMandatoryExtension      = 1010
+	CloseInternalServerErr       = 1011
+	CloseTLSHandshake            = 1015
+)
+
+// rsv1Bit marks a compressed message when permessage-deflate is in use.
+const rsv1Bit = 0x40
+
 const magicWebsocketGUID string = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
 
+const defaultReadBufferSize = 4096
+
+// defaultWriteBufferSize is the size of the bufio.Writer frames are written
+// through, which is also the default size of bufio buffers.
+const defaultWriteBufferSize = 4096
+
+// defaultMaxFragments is the default limit of SetMaxFragments, enough for
+// a 256 MiB message streamed through NextWriter.
+const defaultMaxFragments = 65536
+
+// defaultReadLimit is the default limit of SetReadLimit.
+const defaultReadLimit = 32 << 20
+
+// maxControlPayloadLength is the maximum payload length of control frames.
+const maxControlPayloadLength = 125
+
+// maxCloseReasonLength is the maximum length of a close reason, which
+// shares the control frame payload with the 2 byte status code.
+const maxCloseReasonLength = maxControlPayloadLength - 2
+
+// maxSmallFramePayloadLength is the longest payload whose length fits in
+// the second byte of the frame header.
+const maxSmallFramePayloadLength = 125
+
+// Upper bounds for the handshake headers the package parses. A valid key is
+// 24 bytes long, the list headers are generously sized for real clients.
+const (
+	maxKeyLength        = 64
+	maxHeaderListLength = 4096
+)
+
+// defaultMaxSubprotocols is the default of Upgrader.MaxSubprotocols. The
+// subprotocol count is bounded on its own since every offer is compared to
+// the supported ones.
+const defaultMaxSubprotocols = 64
+
+// ErrHandshakeHeaderTooLarge is returned by Upgrade when a handshake header
+// value exceeds the length the package is willing to parse.
+var ErrHandshakeHeaderTooLarge = errors.New("handshake header too large")
+
+// ErrTooManySubprotocols is returned by Upgrade when a client offers more
+// subprotocols than Upgrader.MaxSubprotocols.
+var ErrTooManySubprotocols = errors.New("too many subprotocols offered")
+
+// ErrBadMethod is returned by Upgrade when the handshake request is not a
+// GET request. The response is 405 Method Not Allowed with an Allow: GET
+// header, which also covers OPTIONS preflights sent to the endpoint.
+var ErrBadMethod = errors.New("handshake request method must be GET")
+
+// ErrUnsupportedVersion is returned by Upgrade when a handshake requests a
+// protocol version other than 13, the only one supported.
+var ErrUnsupportedVersion = errors.New("invalid version")
+
+// ErrUnsupportedDraftHandshake is returned by Upgrade when a client attempts
+// the handshake of a pre-standard draft of the protocol, recognized by its
+// Sec-WebSocket-Key1 and Sec-WebSocket-Key2 headers.
+var ErrUnsupportedDraftHandshake = errors.New("unsupported draft handshake, only version 13 is supported")
+
+// ErrNoSubprotocol is returned by Upgrade when Upgrader.RequireSubprotocol
+// is set and no subprotocol could be selected.
+var ErrNoSubprotocol = errors.New("client offers no supported subprotocol")
+
+// ErrHijackNotSupported is returned by Upgrade when the ResponseWriter does
+// not give access to the underlying connection, e.g. because of a
+// middleware wrapping it without an Unwrap method, or because the request
+// was made over HTTP/2, which only supports websockets through extended
+// CONNECT.
+var ErrHijackNotSupported = errors.New("the http server or middleware does not support connection hijacking, http/2 requires extended connect")
+
+// ErrResponseAlreadyCommitted is returned by Upgrade when the handler wrote
+// to the ResponseWriter before upgrading, so the 101 response can no longer
+// be sent. The ResponseWriter of net/http does not report whether it was
+// written to, so this is only detected through wrappers providing a Written
+// method, as many middleware libraries do, possibly behind others that
+// unwrap to them. Otherwise the handshake proceeds and the client receives
+// the response already written instead of a 101.
+var ErrResponseAlreadyCommitted = errors.New("response already written before upgrading the connection")
+
+// ErrDeadlineNotSupported is returned by the deadline methods when the
+// underlying transport has no notion of deadlines.
+var ErrDeadlineNotSupported = errors.New("deadlines not supported by the underlying connection")
+
+var (
+	// ErrReservedDataOpcode is returned when the peer sends a frame with one
+	// of the reserved non-control opcodes (0x3 - 0x7).
+	ErrReservedDataOpcode = errors.New("reserved non-control opcode")
+	// ErrReservedControlOpcode is returned when the peer sends a frame with one
+	// of the reserved control opcodes (0xB - 0xF).
+	ErrReservedControlOpcode = errors.New("reserved control opcode")
+	// ErrUnexpectedContinuation is returned when the peer sends a continuation
+	// frame while no fragmented message is in progress.
+	ErrUnexpectedContinuation = errors.New("unexpected continuation frame")
+	// ErrExpectedContinuation is returned when the peer starts a new message
+	// before finishing the fragmented message in progress.
+	ErrExpectedContinuation = errors.New("expected continuation frame")
+	// ErrCompressedControlFrame is returned when the peer sends a control
+	// frame with reserved bits set, control frames are never compressed.
+	ErrCompressedControlFrame = errors.New("control frame with reserved bits set")
+	// ErrUnmaskedFrame is returned when a client sends an unmasked frame,
+	// see Upgrader.AllowUnmaskedClientFrames.
+	ErrUnmaskedFrame = errors.New("unmasked frame from client")
+	// ErrMaskedFrame is returned when a server sends a masked frame.
+	ErrMaskedFrame = errors.New("masked frame from server")
+	// ErrReservedBits is returned when the peer sends a data frame with
+	// reserved bits set that no negotiated extension defines.
+	ErrReservedBits = errors.New("frame with reserved bits set without a negotiated extension")
+	// ErrCompressedContinuation is returned when the peer sets the
+	// compression bit on a continuation frame, only the first frame of a
+	// message may carry it.
+	ErrCompressedContinuation = errors.New("continuation frame with compression bit set")
+	// ErrCloseReasonTooLong is returned by CloseWithCode when the reason
+	// does not fit in a Close frame.
+	ErrCloseReasonTooLong = errors.New("close reason exceeds 123 bytes")
+	// ErrControlFrameTooLarge is returned when writing a control frame with
+	// a payload larger than 125 bytes, or when the peer sends one.
+	ErrControlFrameTooLarge = errors.New("control frame payload exceeds 125 bytes")
+	// ErrFragmentedControlFrame is returned when the peer sends a control
+	// frame without the FIN bit set.
+	ErrFragmentedControlFrame = errors.New("fragmented control frame")
+	// ErrFrameTooLarge is returned when the peer sends a frame larger than
+	// the limit set with SetReadFrameLimit.
+	ErrFrameTooLarge = errors.New("frame exceeds the read limit")
+	// ErrMessageTooLarge is returned when the peer sends a message larger
+	// than the limit set with SetReadLimit.
+	ErrMessageTooLarge = errors.New("message exceeds the read limit")
+	// ErrTooManyFragments is returned when the peer splits a message into
+	// more frames than the limit set with SetMaxFragments.
+	ErrTooManyFragments = errors.New("message exceeds the fragment limit")
+	// ErrReadInProgress is returned by SetReadBufferSize and Unread while a
+	// message is partially consumed.
+	ErrReadInProgress = errors.New("message read in progress")
+	// ErrDecompressionRatio is returned when a compressed message inflates
+	// to more than Upgrader.MaxDecompressionRatio times its size.
+	ErrDecompressionRatio = errors.New("message exceeds the decompression ratio")
+	// ErrMessageTypeNotAllowed is returned when the peer sends a message of
+	// a type excluded with SetAllowedMessageTypes.
+	ErrMessageTypeNotAllowed = errors.New("message type not allowed")
+	// ErrInvalidMessageType is returned when writing a message whose type
+	// is neither TextMessage nor BinaryMessage.
+	ErrInvalidMessageType = errors.New("invalid message type")
+	// ErrInvalidFrame is returned by WriteRawFrame when the opcode or the
+	// reserved bits of the frame do not fit in a frame header.
+	ErrInvalidFrame = errors.New("invalid frame opcode or reserved bits")
+	// ErrForwardNotSupported is returned by ForwardTo when the destination
+	// is not a connection created by this package.
+	ErrForwardNotSupported = errors.New("destination does not support frame forwarding")
+	// ErrLifetimeExceeded is the reason a connection is closed with once
+	// Upgrader.MaxConnectionLifetime elapses, as reported by Wait.
+	ErrLifetimeExceeded = errors.New("connection lifetime exceeded")
+	// ErrInvalidUTF8 is returned when text data is not valid UTF-8, be it
+	// written or, in strict mode, received from the peer.
+	ErrInvalidUTF8 = errors.New("invalid utf-8 in text message")
+)
+
 // Conn is an interface that represents a connection
 // that can be used to read and write data.
 type Conn interface {
-	// Write writes data to the connection.
+	// Write writes data to the connection as a single text message.
+	// Writing an empty or nil slice sends an empty text message, which is
+	// valid on the wire, and returns 0 with no error.
 	Write([]byte) (int, error)
-	// Read reads data from the connection.
+	// WriteMessage writes data as a single message of the given type,
+	// either TextMessage or BinaryMessage.
+	WriteMessage(messageType int, data []byte) error
+	// WriteMessageWithDeadline is like WriteMessage, but the write fails if it
+	// does not complete before deadline. The connection-wide write deadline
+	// is restored once the message is written. A message that timed out
+	// after being partially sent leaves the connection unusable.
+	WriteMessageWithDeadline(messageType int, data []byte, deadline time.Time) error
+	// NextWriter returns a writer streaming a message of the given type,
+	// sent in frames as the data is written and completed by closing the
+	// writer. Control frames such as pings may be sent while the message is
+	// being written, but no other message may be written until the writer
+	// is closed. Streamed messages are never compressed.
+	NextWriter(messageType int) (io.WriteCloser, error)
+	// WriteFrom streams the content of r as a message of the given type
+	// until EOF, like copying r into the writer returned by NextWriter,
+	// without holding more than a frame in memory. If reading r fails
+	// after part of the message was sent, the message cannot be completed
+	// and the connection is failed with CloseInternalServerErr.
+	WriteFrom(messageType int, r io.Reader) error
+	// Enqueue adds a message of the given type to the write queue enabled
+	// with Upgrader.WriteQueueSize, applying its policy when the queue is
+	// full. Without a queue it behaves like WriteMessage. The data must not
+	// be modified after calling Enqueue.
+	Enqueue(messageType int, data []byte) error
+	// Pending returns the number of messages waiting in the write queue,
+	// not counting the one being written. It is always zero without a
+	// queue.
+	Pending() int
+	// WriteText writes data as a single text message.
+	WriteText(data []byte) error
+	// WriteBinary writes data as a single binary message.
+	WriteBinary(data []byte) error
+	// SetValidateUTF8 sets whether WriteText checks that data is valid UTF-8
+	// before sending it, failing with ErrInvalidUTF8 otherwise. Disabled by
+	// default.
+	SetValidateUTF8(enabled bool)
+	// Read reads data from the connection. It returns io.EOF when the peer
+	// closed the connection normally, while the message-oriented methods
+	// report the close as a *CloseError. When a frame does not fit in p,
+	// the rest of it is returned by the following calls before any other
+	// frame is read, so control frames sent after it, such as pings or a
+	// Close, are only processed once it has been consumed.
 	Read([]byte) (int, error)
-	// Close closes the connection.
+	// ReadMessage reads the next message, or the rest of the message
+	// partially consumed with Read, and returns its type and content.
+	ReadMessage() (messageType int, data []byte, err error)
+	// ReadJSON reads the next message like ReadMessage and decodes it as
+	// JSON into v. The message is assembled in a pooled buffer, so a loop
+	// of ReadJSON calls does not allocate one per message.
+	ReadJSON(v any) error
+	// Unread pushes a message back so the next Read, ReadMessage or other
+	// message-oriented read returns it before anything else, e.g. to hand
+	// the connection over to another handler after reading one message
+	// too many. It is only safe at a message boundary: it fails with
+	// ErrReadInProgress while a message is partially consumed, which
+	// includes a message already pushed back. ReadRawFrame ignores it.
+	Unread(messageType int, data []byte) error
+	// ReadMessageSpooled is like ReadMessage, but messages larger than the
+	// Upgrader's SpoolThreshold are written to a temporary file instead of
+	// being held in memory. The returned message must be closed to release
+	// its resources.
+	ReadMessageSpooled() (messageType int, message SpooledMessage, err error)
+	// Messages starts a goroutine reading messages and returns the channel
+	// they are delivered on. The channel is closed when reading fails, which
+	// also closes the connection, or when the connection is closed,
+	// MessagesErr then reports why. No other method
+	// reading from the connection may be used once Messages was called.
+	Messages() <-chan InboundMessage
+	// IsAlive reports whether the connection is still usable, without any
+	// I/O. It turns false once the connection is closed, which happens when
+	// a Close frame is sent or received or the connection fails, or once a
+	// read or write broke off in the middle of a frame.
+	IsAlive() bool
+	// Wait blocks until the connection is closed and returns the reason:
+	// a *CloseError when the peer closed it, the error that failed it, or
+	// nil when it was closed by the application. Read errors only close the
+	// connection when they end the Messages channel or Serve.
+	Wait() error
+	// Context returns a context cancelled once the connection is closed,
+	// to stop goroutines serving it. context.Cause reports the error Wait
+	// returns, or context.Canceled if it is nil.
+	Context() context.Context
+	// MessagesErr returns the error that ended the Messages channel, it must
+	// only be called once the channel is closed.
+	MessagesErr() error
+	// SetMessageHandler sets the function Serve calls with every message
+	// read from the connection.
+	SetMessageHandler(handler func(messageType int, data []byte))
+	// Serve reads messages and passes them to the handler set with
+	// SetMessageHandler until reading fails, then closes the connection and
+	// returns the error that ended it, e.g. a *CloseError when the peer
+	// closed the connection. Cancelling ctx closes the connection with
+	// CloseGoingAway and makes Serve return ctx.Err(). Control frames are
+	// handled while reading as with ReadMessage. No other method reading
+	// from the connection may be used while Serve is running.
+	Serve(ctx context.Context) error
+	// Ping sends a ping with an empty payload. Pings received from the
+	// peer are answered automatically while reading.
+	Ping() error
+	// PingWithData sends a ping carrying data, at most 125 bytes long.
+	PingWithData(data []byte) error
+	// Pong sends an unsolicited pong carrying data, at most 125 bytes long,
+	// which the peer does not answer. It can serve as a unidirectional
+	// heartbeat.
+	Pong(data []byte) error
+	// SetPongHandler sets the function called with the payload of every
+	// pong received while reading. It runs on the reading goroutine.
+	SetPongHandler(handler func(data []byte))
+	// ForwardTo reads the next frame and writes it to dst with as little
+	// transformation as possible, which is useful for proxies.
+	ForwardTo(dst Conn) error
+	// ReadRawFrame reads the next frame as is, without reassembling
+	// messages, inflating compressed payloads or handling control frames:
+	// pings are not answered and a Close frame does not close the
+	// connection, the caller is responsible for all of it. It is meant for
+	// proxies inspecting or rewriting frames, and must not be mixed with
+	// the other read methods while a message is in progress.
+	ReadRawFrame() (Frame, error)
+	// WriteRawFrame writes f as is, except for the masking which is applied
+	// if this is the client side of the connection. No check is made that
+	// it fits in the message sequence written so far.
+	WriteRawFrame(f Frame) error
+	// Close closes the connection, first sending a Close frame with the
+	// code set with SetDefaultCloseCode unless the connection is already
+	// closed.
 	Close() error
+	// SetDefaultCloseCode sets the status code of the Close frame sent by
+	// Close, e.g. CloseGoingAway for a server shutting down. Codes that may
+	// not be sent are rejected with ErrInvalidCloseCode. Zero restores the
+	// default, CloseNormalClosure.
+	SetDefaultCloseCode(code int) error
+	// CloseWithCode sends a Close frame with the given status code and
+	// reason, then closes the connection. The reason is limited to 123
+	// bytes so the frame fits the control frame limit, longer ones fail
+	// with ErrCloseReasonTooLong and leave the connection open, as do
+	// codes that may not be sent, with ErrInvalidCloseCode.
+	CloseWithCode(code int, reason string) error
+	// CloseGracefully performs the closing handshake: it sends a Close
+	// frame like CloseWithCode, then discards incoming frames until the
+	// peer answers with its own Close frame, and closes the connection.
+	// It returns the peer's answer as a *CloseError, or ctx.Err() if ctx
+	// is done first. It reads from the connection, so no other read may be
+	// in progress.
+	CloseGracefully(ctx context.Context, code int, reason string) error
+	// SetTruncateCloseReason sets whether CloseWithCode truncates reasons
+	// longer than 123 bytes instead of failing. Truncation never splits a
+	// multi-byte UTF-8 sequence. Disabled by default.
+	SetTruncateCloseReason(enabled bool)
+	// SetReadDeadline sets the deadline for future Read calls.
+	// A zero value for t means Read will not time out. A read that times
+	// out before any byte of a frame arrived can be retried after moving
+	// the deadline, one that times out within a frame fails every later
+	// read.
+	SetReadDeadline(t time.Time) error
+	// SetFrameReadTimeout sets how long reads wait for the next frame to
+	// start arriving. Once its first byte is received the frame is only
+	// bounded by the read deadline, so a peer slowly sending a large frame
+	// is told apart from an idle one. A read that times out this way can
+	// be retried. Zero, the default, means no timeout. It has no effect if
+	// the underlying connection does not support deadlines.
+	SetFrameReadTimeout(d time.Duration)
+	// SetWriteDeadline sets the deadline for future Write calls.
+	// A zero value for t means Write will not time out.
+	SetWriteDeadline(t time.Time) error
+	// SetCompressionThreshold sets the minimum size in bytes a message must
+	// have to be compressed when permessage-deflate was negotiated. Smaller
+	// messages are sent uncompressed, as deflate overhead usually makes them
+	// larger. Defaults to 256 bytes.
+	SetCompressionThreshold(bytes int)
+	// SetReadBufferSize changes the initial size of the buffer frame
+	// payloads are read into, see Upgrader.ReadBufferSize. It must not be
+	// called concurrently with reads, and fails with ErrReadInProgress
+	// while a message is partially consumed. Zero restores the default.
+	SetReadBufferSize(bytes int) error
+	// SetWriteBufferSize changes the size of the buffer frames are written
+	// through, which is 4096 bytes by default, after flushing the frames
+	// it holds. Zero restores the default.
+	SetWriteBufferSize(bytes int) error
+	// SetReadFrameLimit sets the maximum size in bytes of a single frame
+	// read from the peer, regardless of the size of the message it belongs
+	// to. Larger frames fail the connection with CloseMessageTooBig before
+	// their payload is read. Zero means no limit, which is the default.
+	SetReadFrameLimit(bytes int64)
+	// SetReadLimit sets the maximum size in bytes of a message read from
+	// the peer. ReadMessage and the other message-oriented methods enforce
+	// it on the whole message, while Read, which never holds more than a
+	// frame, enforces it on every frame. Either way the connection fails
+	// with CloseMessageTooBig, before reading frames known to exceed it.
+	// Compressed messages are limited by their inflated size. The default
+	// is 32 MiB, which zero or a negative value restores; there is no way
+	// to disable the limit.
+	SetReadLimit(bytes int64)
+	// SetMaxFragments sets the maximum number of frames a message read from
+	// the peer may be split into. A message with more fails the connection
+	// with CloseMessageTooBig, so that a peer cannot waste CPU on frame
+	// parsing with tiny fragments while staying under the read limit.
+	// Defaults to 65536, zero means no limit.
+	SetMaxFragments(n int)
+	// SetAllowedMessageTypes restricts the types of the messages accepted
+	// from the peer to the given ones, TextMessage or BinaryMessage. Other
+	// messages fail the connection with CloseUnsupportedData. Calling it
+	// without arguments accepts both types again, which is the default.
+	SetAllowedMessageTypes(messageTypes ...int)
+	// Subprotocol returns the subprotocol negotiated during the handshake,
+	// or an empty string if none was selected.
+	Subprotocol() string
+	// Extensions returns the Sec-WebSocket-Extensions agreed on during the
+	// handshake, or an empty string if no extension is in use.
+	Extensions() string
+	// NegotiatedExtensions returns the extensions agreed on during the
+	// handshake parsed into their names and parameters.
+	NegotiatedExtensions() []Extension
+	// CompressionEnabled reports whether permessage-deflate was negotiated
+	// during the handshake.
+	CompressionEnabled() bool
+	// LastMessageCompressed reports whether the message being read, or the
+	// last one read, arrived compressed on the wire. Messages are always
+	// returned decompressed, this lets e.g. a proxy decide whether to
+	// compress them again when forwarding.
+	LastMessageCompressed() bool
+	// SetUserData attaches arbitrary application state to the connection,
+	// e.g. the user authenticated during the handshake.
+	SetUserData(data any)
+	// UserData returns the value set with SetUserData, or nil.
+	UserData() any
+	// SetName tags the connection with a name, such as a user or request
+	// id, which prefixes the messages it sends to the Logger hook.
+	SetName(name string)
+	// Name returns the name set with SetName, or an empty string.
+	Name() string
+	// UnderlyingConn returns the network connection the websocket runs on,
+	// or nil if the transport is not a net.Conn. It is an escape hatch for
+	// operations the package does not expose, such as setting socket
+	// options: reading from or writing to it directly corrupts the framing.
+	UnderlyingConn() net.Conn
+}
+
+// readDeadliner and writeDeadliner are the subsets of net.Conn needed
+// to support deadlines, so that transports which only implement reading,
+// writing and closing can still be used.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
 }
 
 type connImpl struct {
-	conn   net.Conn
-	rw     *bufio.ReadWriter
+	conn io.ReadWriteCloser
+	rw   *bufio.ReadWriter
+	// out is the writer rw.Writer flushes to, counting the bytes sent.
+	out    *fullWriter
 	buffer []byte
+	// readBuf backs the payload of the frame being read. It starts at
+	// readBufferSize and only grows when a larger frame arrives.
+	readBuf        []byte
+	readBufferSize int
+	// poolReadBuffer makes readBuf be taken from readBufferPool when a
+	// frame is read and returned to it once consumed.
+	poolReadBuffer bool
+	readFrameLimit int64
+	// readLimit is the maximum size of a message, see SetReadLimit.
+	readLimit int64
+	// allowUnmasked makes the server side accept unmasked frames.
+	allowUnmasked bool
+	// strict enables the checks of Upgrader.StrictMode. utf8Tail holds the
+	// bytes of a character split across fragments of a text message.
+	strict   bool
+	utf8Tail []byte
+	// allowedTypes lists the message types accepted from the peer, nil
+	// meaning all of them.
+	allowedTypes []int
+	// readErr is the error that interrupted a frame partway, after which
+	// nothing more can be read.
+	readErr error
+	// compress reports whether permessage-deflate was negotiated.
+	compress             bool
+	compressionThreshold int
+	// maxDecompressionRatio is Upgrader.MaxDecompressionRatio.
+	maxDecompressionRatio int
+	// fragmented reports whether a fragmented message is being read, in
+	// which case only continuation frames may carry its remaining data.
+	// fragments counts its frames so far, up to maxFragments.
+	fragmented   bool
+	fragments    int
+	maxFragments int
+	// readCompressed reports whether the message being read is compressed,
+	// deflated holds its fragments until the final one arrives.
+	readCompressed bool
+	deflated       []byte
+	// messageType is the type of the message being read.
+	messageType    int
+	spoolThreshold int64
+	// validateUTF8 reports whether WriteText validates its input.
+	validateUTF8 bool
+	// truncateCloseReason makes CloseWithCode shorten long reasons.
+	truncateCloseReason bool
+	// defaultCloseCode is the code Close sends, zero for
+	// CloseNormalClosure.
+	defaultCloseCode int
+	// extensions and subprotocol are the Sec-WebSocket-Extensions and
+	// Sec-WebSocket-Protocol agreed on during the handshake.
+	extensions  string
+	subprotocol string
+	hooks       *Hooks
+	// disableCloseEcho makes the response to a Close frame always use
+	// CloseNormalClosure instead of the code received.
+	disableCloseEcho bool
+	// done is closed along with the underlying connection, and onClose
+	// holds callbacks run at that point.
+	done      chan struct{}
+	onClose   []func()
+	closeOnce sync.Once
+	closeErr  error
+	// closeReason is the error that caused the connection to be closed,
+	// nil when it was closed by the application.
+	closeReason error
+	// ctx is the context returned by Context, created on first use.
+	ctxOnce sync.Once
+	ctx     context.Context
+	// messages is the channel returned by Messages, messagesErr holds the
+	// error that closed it.
+	messagesOnce sync.Once
+	messages     chan InboundMessage
+	messagesErr  error
+	// pongHandler is called with the payload of received pongs.
+	pongHandler func(data []byte)
+	// messageHandler is called by Serve with every message read.
+	messageHandler func(messageType int, data []byte)
+	// queue holds the messages passed to Enqueue until they are written by
+	// writeQueue, it is nil when the write queue is disabled.
+	queue       chan queuedMessage
+	queuePolicy QueuePolicy
+	// userData and name are the values set with SetUserData and SetName,
+	// guarded by userDataMu.
+	userDataMu sync.Mutex
+	userData   any
+	name       string
+	// isClient reports whether this is the client side of the connection,
+	// in which case outgoing frames must be masked.
+	isClient bool
+	// wmu serializes frame writes, as control frames sent from the read
+	// path may race with application writes.
+	wmu sync.Mutex
+	// writeErr is the error of a failed write, which leaves the connection
+	// unable to send further frames. It is guarded by wmu.
+	writeErr error
+	// stats counts the traffic reported by Upgrader.OnConnectionClose.
+	stats connStats
+	// broken is set along with writeErr and readErr, so IsAlive can tell
+	// from any goroutine that the connection can no longer be used.
+	broken atomic.Bool
+	// coalesceWindow is the delay data frames may be buffered for before
+	// being flushed, flushTimer is the pending flush, if any, and is
+	// guarded by wmu.
+	coalesceWindow time.Duration
+	flushTimer     *time.Timer
+	// smallFrame is the scratch space of writeSmallFrameLocked, large
+	// enough for a masked frame with the longest 7-bit payload length.
+	smallFrame [6 + maxSmallFramePayloadLength]byte
+	// writeDeadline is the deadline set with SetWriteDeadline, restored
+	// after a write with its own deadline. readDeadline is likewise
+	// restored once a frame starts within frameReadTimeout.
+	deadlineMu       sync.Mutex
+	writeDeadline    time.Time
+	readDeadline     time.Time
+	frameReadTimeout time.Duration
+}
+
+// Upgrader holds the options used to upgrade an HTTP connection.
+// The zero value is a valid Upgrader using the default options.
+type Upgrader struct {
+	// ReadBufferSize is the initial size in bytes of the per-connection
+	// buffer frame payloads are read into. The buffer grows geometrically
+	// when a larger frame arrives and shrinks back to this size once the
+	// frame has been consumed. Defaults to 4096 bytes.
+	ReadBufferSize int
+	// PoolReadBuffers makes connections share read buffers through a pool
+	// rather than each keeping its own. A buffer is only held while a frame
+	// is being read, so idle connections use no read buffer at all, at the
+	// cost of a pool round trip per message. Buffers grown past
+	// ReadBufferSize for large frames are not pooled.
+	PoolReadBuffers bool
+	// WriteCoalesceWindow, when set, delays flushing written data frames to
+	// the network by up to the given duration so that frames written in
+	// quick succession are sent together, and also flushes whenever the
+	// write buffer fills up. Control frames are sent immediately. A write
+	// then succeeds once buffered, and a failure to send it is reported by
+	// the next one. Closing the connection sends the data not flushed yet.
+	WriteCoalesceWindow time.Duration
+	// EnableCompression allows negotiating the permessage-deflate extension
+	// (RFC 7692) with clients that offer it. Context takeover is always
+	// disabled, so each message is compressed independently.
+	EnableCompression bool
+	// MaxDecompressionRatio fails connections with CloseMessageTooBig when
+	// a compressed message inflates to more than this many times its size
+	// on the wire, catching decompression bombs well before the limit set
+	// with SetReadLimit. Inflating stops as soon as the ratio is exceeded.
+	// Zero means no limit.
+	MaxDecompressionRatio int
+	// CheckExtensions, when set, decides the Sec-WebSocket-Extensions
+	// response for every handshake. It receives the extensions offered by
+	// the client and the response the Upgrader would send, and returns the
+	// one to use, e.g. an empty string to disable compression for clients
+	// known to be buggy. Compression is enabled if the result accepts
+	// permessage-deflate, it must keep the parameters of the proposed
+	// response as no others are supported.
+	CheckExtensions func(r *http.Request, offered string, accepted string) string
+	// Subprotocols lists the subprotocols supported by the server in order
+	// of preference. The first one also offered by the client is selected,
+	// if none is the handshake completes without a subprotocol.
+	Subprotocols []string
+	// SelectSubprotocol, when set, replaces Subprotocols to choose the
+	// subprotocol of every handshake, e.g. to only allow some of them to
+	// clients with the right credentials. It receives the subprotocols
+	// offered by the client, as in HandshakeInfo.Subprotocols, and returns
+	// the one to select or an empty string for none. A subprotocol the
+	// client did not offer is treated as none.
+	SelectSubprotocol func(r *http.Request, offered []string) string
+	// RequireSubprotocol rejects handshakes with 400 Bad Request when no
+	// subprotocol is selected, instead of completing them without one. It
+	// has no effect if neither Subprotocols nor SelectSubprotocol is set.
+	RequireSubprotocol bool
+	// MaxSubprotocols is the number of subprotocols a client may offer.
+	// Handshakes offering more are rejected with 400 Bad Request before
+	// any of them is compared to the supported ones. Defaults to 64.
+	MaxSubprotocols int
+	// OnHandshakeRequest, when set, is called with every valid handshake
+	// request before the connection is upgraded, e.g. to look up the
+	// session of a cookie. The returned value is attached to the Conn as
+	// with SetUserData. Returning an error rejects the handshake with
+	// 403 Forbidden, and Upgrade returns that error.
+	OnHandshakeRequest func(r *http.Request) (userData any, err error)
+	// Hooks are invoked as upgraded connections are used, see Hooks.
+	Hooks *Hooks
+	// OnConnectionClose, when set, is called once every upgraded
+	// connection is closed with a summary of its lifetime, e.g. to write
+	// an access log. It runs on the goroutine closing the connection.
+	OnConnectionClose func(summary ConnSummary)
+	// SpoolThreshold is the size in bytes above which ReadMessageSpooled
+	// stores a message in a temporary file rather than in memory. Zero
+	// means messages are always kept in memory.
+	SpoolThreshold int64
+	// AllowUnmaskedClientFrames accepts frames that clients send unmasked,
+	// which are otherwise rejected with CloseProtocolError as the protocol
+	// requires. It only exists for interoperability with non-conforming
+	// clients: masking protects intermediaries that do not understand
+	// websockets from cache poisoning by crafted payloads, and that
+	// protection is lost.
+	AllowUnmaskedClientFrames bool
+	// StrictMode makes connections enforce every requirement RFC 6455 puts
+	// on received frames, failing the connection on the first violation.
+	// On top of the checks always performed, text messages and close
+	// reasons must be valid UTF-8 (CloseInvalidFramePayloadData).
+	// AllowUnmaskedClientFrames is ignored.
+	StrictMode bool
+	// DefaultCloseCode is the status code sent by Conn.Close, see
+	// Conn.SetDefaultCloseCode. Defaults to CloseNormalClosure. A code that
+	// may not be sent makes every Upgrade fail with ErrInvalidCloseCode.
+	DefaultCloseCode int
+	// DisableCloseEcho makes connections answer a Close frame from the
+	// client with CloseNormalClosure instead of mirroring its status code.
+	DisableCloseEcho bool
+	// MaxConnectionsPerIP limits the number of simultaneous connections
+	// from a single client IP, further handshakes are rejected with
+	// 503 Service Unavailable. Zero means no limit.
+	MaxConnectionsPerIP int
+	// TrustForwardedHeaders makes the client IP be taken from the last
+	// X-Forwarded-For entry, the one appended by the proxy in front of the
+	// server, or from the X-Real-IP header when present. Only enable it
+	// behind a single proxy that sets them, as clients can forge them
+	// otherwise.
+	TrustForwardedHeaders bool
+	// WriteQueueSize enables an outbound queue of the given capacity on
+	// every connection, filled by Conn.Enqueue and drained by a dedicated
+	// goroutine. Zero disables the queue and makes Enqueue write directly.
+	WriteQueueSize int
+	// WriteQueuePolicy decides what happens to messages enqueued while the
+	// queue is full. Defaults to QueueBlock.
+	WriteQueuePolicy QueuePolicy
+	// MaxConnectionLifetime closes connections with CloseGoingAway once
+	// they have been open for the given duration, forcing clients to
+	// reconnect, e.g. to present rotated credentials. Zero means no limit.
+	MaxConnectionLifetime time.Duration
+
+	// drainMu guards the count of active connections, drained is closed
+	// whenever it drops to zero.
+	drainMu sync.Mutex
+	active  int
+	drained chan struct{}
+	// connsPerIP counts the open connections of every client IP that has
+	// at least one, guarded by ipMu.
+	ipMu       sync.Mutex
+	connsPerIP map[string]int
+}
+
+var defaultUpgrader = &Upgrader{}
+
+// trackConnection registers a new active connection and returns the
+// function to call once it is closed.
+func (u *Upgrader) trackConnection() func() {
+	u.drainMu.Lock()
+	defer u.drainMu.Unlock()
+
+	if u.active == 0 {
+		u.drained = make(chan struct{})
+	}
+
+	u.active++
+
+	return func() {
+		u.drainMu.Lock()
+		defer u.drainMu.Unlock()
+
+		u.active--
+
+		if u.active == 0 {
+			close(u.drained)
+		}
+	}
+}
+
+// ActiveConnections returns the number of connections upgraded by u that
+// are still open.
+func (u *Upgrader) ActiveConnections() int {
+	u.drainMu.Lock()
+	defer u.drainMu.Unlock()
+
+	return u.active
+}
+
+// WaitForDrain blocks until every connection upgraded by u is closed or ctx
+// is done, in which case it returns the context's error. It is meant to be
+// used during a graceful shutdown, once no new connections are accepted.
+func (u *Upgrader) WaitForDrain(ctx context.Context) error {
+	u.drainMu.Lock()
+
+	if u.active == 0 {
+		u.drainMu.Unlock()
+		return nil
+	}
+
+	drained := u.drained
+	u.drainMu.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Upgrades an HTTP connection to handle websocket communication.
 // This function will return a Conn interface that can be used to read
 // and write data, it adheres to the io.Reader and io.Writer interfaces.
+// It is a shorthand for calling Upgrade on a zero Upgrader.
 func Upgrade(w http.ResponseWriter, r *http.Request) (Conn, error) {
+	return defaultUpgrader.Upgrade(w, r)
+}
+
+// HandshakeInfo holds the details of an opening handshake request parsed
+// by CheckHandshake.
+type HandshakeInfo struct {
+	// Key is the Sec-WebSocket-Key sent by the client.
+	Key string
+	// Subprotocols lists the subprotocols offered by the client in order of
+	// preference.
+	Subprotocols []string
+	// Extensions is the Sec-WebSocket-Extensions offered by the client,
+	// with multiple header lines joined by commas.
+	Extensions string
+	// Origin is the Origin header, empty for non-browser clients.
+	Origin string
+}
+
+// CheckHandshake validates the headers of an opening handshake request as
+// Upgrade does and returns the details parsed from them. It leaves the
+// response untouched, so the request can be inspected before deciding
+// whether to upgrade it.
+func CheckHandshake(r *http.Request) (HandshakeInfo, error) {
+	if r.Method != http.MethodGet {
+		return HandshakeInfo{}, ErrBadMethod
+	}
+
 	h := r.Header
 
+	// Handshakes of the hixie drafts carry two keys instead of one and no
+	// version, they are told apart here so they don't fail on some header
+	// that merely differs from version 13.
+	if h.Get("Sec-WebSocket-Key1") != "" || h.Get("Sec-WebSocket-Key2") != "" {
+		return HandshakeInfo{}, ErrUnsupportedDraftHandshake
+	}
+
 	if h.Get("Connection") != "Upgrade" {
-		return nil, errors.New("missing 'connection' header")
+		return HandshakeInfo{}, errors.New("missing 'connection' header")
 	}
 
 	if h.Get("Upgrade") != "websocket" {
-		return nil, errors.New("missing 'upgrade' header")
+		return HandshakeInfo{}, errors.New("missing 'upgrade' header")
 	}
 
 	if h.Get("Sec-WebSocket-Version") != "13" {
-		return nil, errors.New("invalid version")
+		return HandshakeInfo{}, ErrUnsupportedVersion
+	}
+
+	// The HTTP server already trims header values read from the wire, but
+	// requests built in code may not be, and the accept hash must be computed
+	// over the bare key.
+	key := strings.TrimSpace(h.Get("Sec-WebSocket-Key"))
+
+	if key == "" {
+		return HandshakeInfo{}, errors.New("missing 'sec-websocket-key' header")
+	}
+
+	if len(key) > maxKeyLength {
+		return HandshakeInfo{}, ErrHandshakeHeaderTooLarge
+	}
+
+	if headerListLength(h, "Sec-WebSocket-Protocol") > maxHeaderListLength {
+		return HandshakeInfo{}, ErrHandshakeHeaderTooLarge
+	}
+
+	if headerListLength(h, "Sec-WebSocket-Extensions") > maxHeaderListLength {
+		return HandshakeInfo{}, ErrHandshakeHeaderTooLarge
+	}
+
+	return HandshakeInfo{
+		Key:          key,
+		Subprotocols: parseHeaderList(h.Values("Sec-WebSocket-Protocol")),
+		Extensions:   strings.Join(h.Values("Sec-WebSocket-Extensions"), ", "),
+		Origin:       h.Get("Origin"),
+	}, nil
+}
+
+// Upgrade upgrades an HTTP connection to handle websocket communication
+// using the options set on u. When the handshake fails, an HTTP error
+// response is written to w and the error is returned.
+//
+// Frames the client sends right after its handshake request, possibly in
+// the same packet, are kept and returned by the first read on the Conn, so
+// the server can read a first message, e.g. to authenticate the client,
+// before deciding to keep the connection.
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request) (Conn, error) {
+	conn, err := u.upgrade(w, r)
+	u.Hooks.handshake(err)
+
+	return conn, err
+}
+
+func (u *Upgrader) upgrade(w http.ResponseWriter, r *http.Request) (Conn, error) {
+	info, err := CheckHandshake(r)
+
+	if err == ErrUnsupportedVersion || err == ErrUnsupportedDraftHandshake {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return u.reject(w, http.StatusUpgradeRequired, err)
+	}
+
+	if err == ErrBadMethod {
+		w.Header().Set("Allow", http.MethodGet)
+		return u.reject(w, http.StatusMethodNotAllowed, err)
+	}
+
+	if err != nil {
+		return u.reject(w, http.StatusBadRequest, err)
+	}
+
+	maxSubprotocols := u.MaxSubprotocols
+
+	if maxSubprotocols <= 0 {
+		maxSubprotocols = defaultMaxSubprotocols
+	}
+
+	if len(info.Subprotocols) > maxSubprotocols {
+		return u.reject(w, http.StatusBadRequest, ErrTooManySubprotocols)
+	}
+
+	if responseCommitted(w) {
+		return nil, ErrResponseAlreadyCommitted
+	}
+
+	if !canHijack(w) {
+		return u.reject(w, http.StatusInternalServerError, ErrHijackNotSupported)
+	}
+
+	if u.DefaultCloseCode != 0 && !validCloseCode(u.DefaultCloseCode) {
+		return u.reject(w, http.StatusInternalServerError, ErrInvalidCloseCode)
+	}
+
+	subprotocol := selectSubprotocol(u.Subprotocols, info.Subprotocols)
+
+	if u.SelectSubprotocol != nil {
+		subprotocol = u.SelectSubprotocol(r, info.Subprotocols)
+
+		if !slices.Contains(info.Subprotocols, subprotocol) {
+			subprotocol = ""
+		}
+	}
+
+	if subprotocol == "" && u.RequireSubprotocol && (len(u.Subprotocols) > 0 || u.SelectSubprotocol != nil) {
+		return u.reject(w, http.StatusBadRequest, ErrNoSubprotocol)
+	}
+
+	var userData any
+
+	if u.OnHandshakeRequest != nil {
+		userData, err = u.OnHandshakeRequest(r)
+
+		if err != nil {
+			return u.reject(w, http.StatusForbidden, err)
+		}
 	}
 
-	if h.Get("Sec-WebSocket-Key") == "" {
-		return nil, errors.New("missing 'sec-websocket-key' header")
+	releaseIP, ok := u.acquireIP(u.clientIP(r))
+
+	if !ok {
+		return u.reject(w, http.StatusServiceUnavailable, ErrTooManyConnections)
+	}
+
+	secKey := hashKey(info.Key)
+
+	extensions := ""
+
+	if u.EnableCompression && negotiateDeflate(parseExtensions([]string{info.Extensions})) {
+		extensions = deflateResponse
+	}
+
+	if u.CheckExtensions != nil {
+		extensions = u.CheckExtensions(r, info.Extensions, extensions)
 	}
 
-	key := h.Get("Sec-WebSocket-Key")
+	compress := hasExtension(parseExtensions([]string{extensions}), "permessage-deflate")
+
+	if extensions != "" {
+		w.Header().Set("Sec-WebSocket-Extensions", extensions)
+	}
 
-	secKey := hashKey(key)
+	if subprotocol != "" {
+		w.Header().Set("Sec-WebSocket-Protocol", subprotocol)
+	}
 
 	w.Header().Set("Upgrade", "websocket")
 	w.Header().Set("Connection", "Upgrade")
@@ -72,162 +973,1650 @@ func Upgrade(w http.ResponseWriter, r *http.Request) (Conn, error) {
 
 	conn, rw, err := http.NewResponseController(w).Hijack()
 
+	if errors.Is(err, http.ErrNotSupported) {
+		err = ErrHijackNotSupported
+	}
+
 	if err != nil {
+		releaseIP()
 		return nil, err
 	}
 
-	return &connImpl{
-		conn:   conn,
-		rw:     rw,
-		buffer: nil,
-	}, nil
+	// rw.Reader is kept as is, since it may already hold frames pipelined
+	// by the client after its request.
+	out := &fullWriter{w: conn}
+	rw.Writer.Reset(out)
+
+	readBufferSize := u.ReadBufferSize
+
+	if readBufferSize <= 0 {
+		readBufferSize = defaultReadBufferSize
+	}
+
+	var readBuf []byte
+
+	if !u.PoolReadBuffers {
+		readBuf = make([]byte, readBufferSize)
+	}
+
+	c := &connImpl{
+		conn:           conn,
+		rw:             rw,
+		out:            out,
+		buffer:         nil,
+		readBuf:        readBuf,
+		readBufferSize: readBufferSize,
+		poolReadBuffer: u.PoolReadBuffers,
+		coalesceWindow: u.WriteCoalesceWindow,
+
+		compress:             compress,
+		compressionThreshold: defaultCompressionThreshold,
+		maxFragments:         defaultMaxFragments,
+		readLimit:            defaultReadLimit,
+		extensions:           extensions,
+		subprotocol:          subprotocol,
+		hooks:                u.Hooks,
+		disableCloseEcho:     u.DisableCloseEcho,
+		defaultCloseCode:     u.DefaultCloseCode,
+		allowUnmasked:        u.AllowUnmaskedClientFrames,
+		strict:               u.StrictMode,
+		spoolThreshold:       u.SpoolThreshold,
+		userData:             userData,
+		done:                 make(chan struct{}),
+
+		maxDecompressionRatio: u.MaxDecompressionRatio,
+	}
+
+	c.onClose = append(c.onClose, u.trackConnection(), releaseIP)
+	c.stats.start = time.Now()
+
+	if u.OnConnectionClose != nil {
+		c.onClose = append(c.onClose, func() { u.OnConnectionClose(c.summary()) })
+	}
+
+	// The lifetime is awaited by a goroutine rather than a timer stopped
+	// from onClose, which a timer firing early would read while it is
+	// still being set up.
+	if u.MaxConnectionLifetime > 0 {
+		go func() {
+			timer := time.NewTimer(u.MaxConnectionLifetime)
+			defer timer.Stop()
+
+			select {
+			case <-timer.C:
+				c.writeClose(CloseGoingAway, "")
+				c.closeConn(ErrLifetimeExceeded)
+			case <-c.done:
+			}
+		}()
+	}
+
+	if u.WriteQueueSize > 0 {
+		c.queue = make(chan queuedMessage, u.WriteQueueSize)
+		c.queuePolicy = u.WriteQueuePolicy
+
+		go c.writeQueue()
+	}
+
+	return c, nil
 }
 
-func (c *connImpl) Write(p []byte) (int, error) {
-	frame := getDataFrame(len(p))
+// reject writes an error response with the given status and returns err.
+func (u *Upgrader) reject(w http.ResponseWriter, status int, err error) (Conn, error) {
+	http.Error(w, err.Error(), status)
 
-	_, err := c.rw.Write(frame)
+	return nil, err
+}
 
-	if err != nil {
-		return 0, err
+func (c *connImpl) Write(p []byte) (int, error) {
+	return c.writeFrame(opCodeText, p)
+}
+
+func (c *connImpl) WriteMessage(messageType int, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return ErrInvalidMessageType
 	}
 
-	n, err := c.rw.Write(p)
+	_, err := c.writeFrame(byte(messageType), data)
 
-	if err != nil {
-		return 0, err
+	return err
+}
+
+func (c *connImpl) WriteText(data []byte) error {
+	if c.validateUTF8 && !utf8.Valid(data) {
+		return ErrInvalidUTF8
 	}
 
-	err = c.rw.Flush()
+	return c.WriteMessage(TextMessage, data)
+}
 
-	return n, err
+func (c *connImpl) WriteBinary(data []byte) error {
+	return c.WriteMessage(BinaryMessage, data)
 }
 
-func (c *connImpl) Read(p []byte) (int, error) {
-	if c.buffer != nil {
-		n := copy(p, c.buffer)
+func (c *connImpl) SetValidateUTF8(enabled bool) {
+	c.validateUTF8 = enabled
+}
 
-		if n == len(c.buffer) {
-			c.buffer = nil
-		} else {
-			c.buffer = c.buffer[n:]
-		}
+func (c *connImpl) WriteMessageWithDeadline(messageType int, data []byte, deadline time.Time) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return ErrInvalidMessageType
+	}
 
-		return n, nil
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	d, ok := c.conn.(writeDeadliner)
+
+	if !ok {
+		return ErrDeadlineNotSupported
 	}
 
-	for {
-		frame := make([]byte, 2)
+	if err := d.SetWriteDeadline(deadline); err != nil {
+		return deadlineError(err)
+	}
+
+	_, err := c.writeFrameLocked(byte(messageType), data)
+
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+
+	if restoreErr := d.SetWriteDeadline(c.writeDeadline); err == nil {
+		err = restoreErr
+	}
+
+	return err
+}
+
+// writeFrame writes a single final frame with the given opcode and payload.
+func (c *connImpl) writeFrame(opCode byte, p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	return c.writeFrameLocked(opCode, p)
+}
+
+// writeFrameLocked is like writeFrame but must be called with c.wmu held.
+func (c *connImpl) writeFrameLocked(opCode byte, p []byte) (int, error) {
+	payload := p
+	rsv := byte(0)
+
+	if c.compress && (opCode == opCodeText || opCode == opCodeBinary) && len(p) >= c.compressionThreshold {
+		var err error
 
-		_, err := c.rw.Read(frame)
+		payload, err = compressPayload(p)
 
 		if err != nil {
 			return 0, err
 		}
 
-		opCode := frame[0] & 0x0F
-		payloadLength := int(frame[1] & 0x7F)
+		rsv = rsv1Bit
+	}
+
+	if err := c.writeRawFrameLocked(true, rsv, opCode, payload); err != nil {
+		return 0, err
+	}
 
-		switch opCode {
-		case opCodeText, opCodeBinary:
-			if payloadLength == 0x7E {
-				payload := make([]byte, 2)
+	return len(p), nil
+}
 
-				_, err = c.rw.Read(payload)
+// writeRawFrameLocked writes a frame with the given header bits and payload
+// as-is, masking it when writing from the client side. It must be called
+// with c.wmu held.
+func (c *connImpl) writeRawFrameLocked(fin bool, rsv byte, opCode byte, payload []byte) error {
+	if len(payload) <= maxSmallFramePayloadLength {
+		return c.writeSmallFrameLocked(fin, rsv, opCode, payload)
+	}
 
-				if err != nil {
-					return 0, err
-				}
+	header := getDataFrame(opCode, int64(len(payload)))
+	header[0] |= rsv & 0x70
 
-				payloadLength = int(payload[0])<<0x08 | int(payload[1])
-			} else if payloadLength == 0x7F {
-				payload := make([]byte, 8)
+	if !fin {
+		header[0] &^= 0x80
+	}
 
-				_, err = c.rw.Read(payload)
+	if c.isClient {
+		mask := make([]byte, 4)
 
-				if err != nil {
-					return 0, err
-				}
+		if _, err := rand.Read(mask); err != nil {
+			return err
+		}
 
-				payloadLength = int(payload[0])<<0x38 | int(payload[1])<<0x30 | int(payload[2])<<0x28 | int(payload[3])<<0x20 | int(payload[4])<<0x18 | int(payload[5])<<0x10 | int(payload[6])<<0x08 | int(payload[7])
-			}
+		header[1] |= 0x80
+		header = append(header, mask...)
 
-			mask := make([]byte, 4)
+		masked := make([]byte, len(payload))
+		copy(masked, payload)
+		maskBytes(mask, masked)
 
-			_, err = c.rw.Read(mask)
+		payload = masked
+	}
 
-			if err != nil {
-				return 0, err
-			}
+	if err := c.sendLocked(header, payload); err != nil {
+		return err
+	}
 
-			payload := make([]byte, payloadLength)
+	c.hooks.frameWrite(opCode, len(payload))
+	c.stats.frameWrite(fin, opCode, len(payload))
 
-			_, err = c.rw.Read(payload)
+	return nil
+}
 
-			if err != nil {
-				return 0, err
-			}
+// writeSmallFrameLocked writes a frame whose payload length fits in the
+// 7-bit length field of the header. The header and payload are assembled
+// in c.smallFrame and written at once, so small messages are sent without
+// allocating. It must be called with c.wmu held.
+func (c *connImpl) writeSmallFrameLocked(fin bool, rsv byte, opCode byte, payload []byte) error {
+	frame := c.smallFrame[:2]
+	frame[0] = opCode&0x0F | rsv&0x70
+	frame[1] = byte(len(payload))
 
-			for i := 0; i < len(payload); i++ {
-				payload[i] ^= mask[i%4]
-			}
+	if fin {
+		frame[0] |= 0x80
+	}
 
-			if payloadLength > len(p) {
-				n := copy(p, payload)
+	if c.isClient {
+		mask := c.smallFrame[2:6]
 
-				c.buffer = payload[n:]
+		if _, err := rand.Read(mask); err != nil {
+			return err
+		}
 
-				return n, nil
-			}
+		frame[1] |= 0x80
+		frame = append(c.smallFrame[:6], payload...)
+		maskBytes(mask, frame[6:])
+	} else {
+		frame = append(frame, payload...)
+	}
 
-			copy(p, payload)
+	if err := c.sendLocked(frame, nil); err != nil {
+		return err
+	}
 
-			return len(payload), nil
-		case opCodePing, opCodePong:
-			// TODO: Handle ping and pong later.
-		case opCodeClose:
-			return 0, errors.New("connection closed")
-		default:
-			return 0, errors.New("unknown opcode")
+	c.hooks.frameWrite(opCode, len(payload))
+	c.stats.frameWrite(fin, opCode, len(payload))
+
+	return nil
+}
+
+// sendLocked writes a frame split into its header and payload and flushes
+// it. A failed write may have sent part of the frame, after which the
+// stream cannot be resynchronized, so every later write fails with the
+// same error. A write failing before any byte reached the connection,
+// such as one timing out against a peer that is not reading, only drops
+// the frame. It must be called with c.wmu held.
+func (c *connImpl) sendLocked(header []byte, payload []byte) error {
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+
+	sent, buffered := c.out.sent, c.rw.Writer.Buffered()
+
+	// A payload larger than the room left in the buffer only fills it, the
+	// rest is written straight to the connection by bufio, so large frames
+	// are not copied twice.
+	_, err := c.rw.Write(header)
+
+	if err == nil {
+		_, err = c.rw.Write(payload)
+	}
+
+	// Data frames are left buffered for up to the coalescing window so
+	// that a burst of them is sent at once, control frames are flushed
+	// right away along with the frames buffered before them.
+	if err == nil && c.coalesceWindow > 0 && header[0]&0x08 == 0 {
+		if c.flushTimer == nil {
+			c.flushTimer = time.AfterFunc(c.coalesceWindow, c.flushCoalesced)
 		}
+
+		return nil
+	}
+
+	if err == nil {
+		err = c.rw.Flush()
+	}
+
+	// The bufio writer keeps failing once a write failed, so it is reset,
+	// which is only possible if it held no frame buffered earlier.
+	if err != nil && c.out.sent == sent && buffered == 0 {
+		c.rw.Writer.Reset(c.out)
+		return err
+	}
+
+	if err != nil {
+		c.writeErr = err
+		c.broken.Store(true)
 	}
+
+	return err
 }
 
-func (c *connImpl) Close() error {
-	return c.conn.Close()
+// flushCoalesced sends the frames buffered during the coalescing window.
+func (c *connImpl) flushCoalesced() {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.flushTimer = nil
+
+	if c.writeErr != nil {
+		return
+	}
+
+	if err := c.rw.Flush(); err != nil {
+		c.writeErr = err
+		c.broken.Store(true)
+	}
 }
 
-// hashKey hashes a key using the SHA1 algorithm and returns the base64 encoded result.
-// It is required to hash the key provided by the client and append a predefined GUID
-// to it before encoding it to base64. This comes from the original WebSocket spec.
-func hashKey(key string) string {
-	h := sha1.New()
-	h.Write([]byte(key + magicWebsocketGUID))
-	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+// flushBuffered sends the frames held back by the coalescing window before
+// the connection is closed. A write blocked on a peer that stopped reading
+// holds wmu, in which case nothing is flushed, so that closing the
+// connection still unblocks it.
+func (c *connImpl) flushBuffered() {
+	if !c.wmu.TryLock() {
+		return
+	}
+
+	defer c.wmu.Unlock()
+
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushTimer = nil
+	}
+
+	if c.writeErr == nil && c.rw.Writer.Buffered() > 0 {
+		c.rw.Flush()
+	}
+}
+
+// fullWriter retries the short writes of transports that return fewer
+// bytes than requested without an error, instead of letting bufio give up
+// with io.ErrShortWrite in the middle of a frame.
+type fullWriter struct {
+	w io.Writer
+	// sent counts the bytes written to w, guarded by wmu like the bufio
+	// writer in front of it.
+	sent int64
 }
 
-// getDataFrame returns the beginning of a WebSocket frame with the given size.
-func getDataFrame(size int) []byte {
-	buffer := make([]byte, 0)
+func (fw *fullWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for written < len(p) {
+		n, err := fw.w.Write(p[written:])
+		written += n
+		fw.sent += int64(n)
+
+		if err != nil {
+			return written, err
+		}
+
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+
+	return written, nil
+}
+
+func (c *connImpl) Ping() error {
+	return c.PingWithData(nil)
+}
+
+func (c *connImpl) PingWithData(data []byte) error {
+	if len(data) > maxControlPayloadLength {
+		return ErrControlFrameTooLarge
+	}
+
+	_, err := c.writeFrame(opCodePing, data)
+
+	return err
+}
+
+func (c *connImpl) Pong(data []byte) error {
+	if len(data) > maxControlPayloadLength {
+		return ErrControlFrameTooLarge
+	}
+
+	_, err := c.writeFrame(opCodePong, data)
+
+	return err
+}
+
+func (c *connImpl) SetPongHandler(handler func(data []byte)) {
+	c.pongHandler = handler
+}
+
+// ForwardTo reads the next frame and writes it to dst unchanged, except for
+// the masking which is redone only if dst is the client side of its
+// connection. Control frames are forwarded as well rather than handled.
+// Compressed messages are inflated first if dst did not negotiate
+// compression, in which case all their fragments are read and forwarded as
+// a single frame. It must not be used while a message is partially
+// consumed with Read.
+func (c *connImpl) ForwardTo(dst Conn) error {
+	w, ok := dst.(rawFrameWriter)
+
+	if !ok {
+		return ErrForwardNotSupported
+	}
+
+	f, err := c.readFrame()
+
+	if err != nil {
+		return err
+	}
+
+	if c.compress && f.rsv&rsv1Bit != 0 && !dst.CompressionEnabled() {
+		return c.forwardInflated(w, f)
+	}
+
+	err = w.writeRawFrame(f.fin, f.rsv, f.opCode, f.payload)
+	c.shrinkReadBuffer()
+
+	return err
+}
+
+// forwardInflated forwards the compressed message starting with f as a
+// single uncompressed frame. A compressed message can only be inflated as
+// a whole, so its fragments are collected first, while the control frames
+// received in between are forwarded as they arrive.
+func (c *connImpl) forwardInflated(w rawFrameWriter, first frame) error {
+	deflated := first.payload
+
+	if !first.fin {
+		deflated = bytes.Clone(first.payload)
+		c.shrinkReadBuffer()
+	}
+
+	for fin := first.fin; !fin; {
+		f, err := c.readFrame()
+
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case f.opCode&0x08 != 0:
+			err = w.writeRawFrame(f.fin, f.rsv, f.opCode, f.payload)
+		case f.opCode == opCodeContinuation:
+			if deflatedTooLarge(len(deflated)+len(f.payload), c.readLimit) {
+				err = c.fail(CloseMessageTooBig, ErrMessageTooLarge)
+				break
+			}
+
+			deflated = append(deflated, f.payload...)
+			fin = f.fin
+		default:
+			err = c.fail(CloseProtocolError, ErrExpectedContinuation)
+		}
+
+		c.shrinkReadBuffer()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	payload, err := decompressPayload(deflated, c.readLimit, c.maxDecompressionRatio)
+	c.shrinkReadBuffer()
+
+	if err != nil {
+		return c.fail(inflateCloseCode(err), err)
+	}
+
+	return w.writeRawFrame(true, first.rsv&^rsv1Bit, first.opCode, payload)
+}
+
+// Frame is a single frame as read by ReadRawFrame and written by
+// WriteRawFrame.
+type Frame struct {
+	// Fin is set on the final frame of a message and on control frames.
+	Fin bool
+	// RSV holds the RSV1, RSV2 and RSV3 bits at their position in the first
+	// header byte, 0x40, 0x20 and 0x10 respectively.
+	RSV byte
+	// OpCode is the opcode of the frame, e.g. 0x1 for text, 0x0 for a
+	// continuation or 0x9 for a ping.
+	OpCode int
+	// Payload is the unmasked payload.
+	Payload []byte
+}
+
+func (c *connImpl) ReadRawFrame() (Frame, error) {
+	f, err := c.readFrame()
+
+	if err != nil {
+		return Frame{}, err
+	}
+
+	// The payload shares the read buffer, which is reused or pooled.
+	payload := bytes.Clone(f.payload)
+	c.shrinkReadBuffer()
+
+	return Frame{Fin: f.fin, RSV: f.rsv, OpCode: int(f.opCode), Payload: payload}, nil
+}
+
+func (c *connImpl) WriteRawFrame(f Frame) error {
+	if f.OpCode < 0 || f.OpCode > 0x0F || f.RSV&^0x70 != 0 {
+		return ErrInvalidFrame
+	}
+
+	if f.OpCode&0x08 != 0 && len(f.Payload) > maxControlPayloadLength {
+		return ErrControlFrameTooLarge
+	}
+
+	return c.writeRawFrame(f.Fin, f.RSV, byte(f.OpCode), f.Payload)
+}
+
+// rawFrameWriter is implemented by connections ForwardTo can write to.
+type rawFrameWriter interface {
+	writeRawFrame(fin bool, rsv byte, opCode byte, payload []byte) error
+}
+
+func (c *connImpl) writeRawFrame(fin bool, rsv byte, opCode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	return c.writeRawFrameLocked(fin, rsv, opCode, payload)
+}
+
+func (c *connImpl) CompressionEnabled() bool {
+	return c.compress
+}
+
+func (c *connImpl) LastMessageCompressed() bool {
+	return c.readCompressed
+}
+
+func (c *connImpl) Read(p []byte) (int, error) {
+	if c.buffer != nil {
+		n := copy(p, c.buffer)
+
+		if n == len(c.buffer) {
+			c.buffer = nil
+			c.shrinkReadBuffer()
+		} else {
+			c.buffer = c.buffer[n:]
+		}
+
+		return n, nil
+	}
+
+	payload, _, err := c.readDataFrame()
+
+	if err != nil {
+		return 0, readError(err)
+	}
+
+	if len(payload) > len(p) {
+		n := copy(p, payload)
+
+		c.buffer = payload[n:]
+
+		return n, nil
+	}
+
+	copy(p, payload)
+	c.shrinkReadBuffer()
+
+	return len(payload), nil
+}
+
+// readError maps a clean close by the peer to io.EOF, so that Read ends
+// the stream the way io.Reader consumers such as io.Copy expect.
+func readError(err error) error {
+	var closeErr *CloseError
+
+	if errors.As(err, &closeErr) && (closeErr.Code == CloseNormalClosure || closeErr.Code == CloseNoStatusReceived) {
+		return io.EOF
+	}
+
+	return err
+}
+
+// readDataFrame reads frames until a data frame arrives and returns its
+// payload and whether it ends the message, handling the control frames
+// received in between. The type of the message it belongs to is stored
+// in c.messageType. Compressed messages are returned whole once inflated.
+func (c *connImpl) readDataFrame() ([]byte, bool, error) {
+	for {
+		f, err := c.readFrame()
+
+		if err != nil {
+			return nil, false, err
+		}
+
+		switch f.opCode {
+		case opCodeText, opCodeBinary, opCodeContinuation:
+			if f.opCode == opCodeContinuation && !c.fragmented {
+				return nil, false, c.fail(CloseProtocolError, ErrUnexpectedContinuation)
+			}
+
+			if f.opCode != opCodeContinuation && c.fragmented {
+				return nil, false, c.fail(CloseProtocolError, ErrExpectedContinuation)
+			}
+
+			// RSV1 is only meaningful with permessage-deflate, and then only
+			// on the first frame of a message, RSV2 and RSV3 are never used.
+			if f.rsv&^rsv1Bit != 0 || f.rsv != 0 && !c.compress {
+				return nil, false, c.fail(CloseProtocolError, ErrReservedBits)
+			}
+
+			if f.opCode == opCodeContinuation && f.rsv != 0 {
+				return nil, false, c.fail(CloseProtocolError, ErrCompressedContinuation)
+			}
+
+			if f.opCode == opCodeContinuation {
+				c.fragments++
+			} else {
+				c.fragments = 1
+			}
+
+			if c.maxFragments > 0 && c.fragments > c.maxFragments {
+				return nil, false, c.fail(CloseMessageTooBig, ErrTooManyFragments)
+			}
+
+			if f.opCode != opCodeContinuation {
+				if c.allowedTypes != nil && !slices.Contains(c.allowedTypes, int(f.opCode)) {
+					return nil, false, c.fail(CloseUnsupportedData, ErrMessageTypeNotAllowed)
+				}
+
+				c.messageType = int(f.opCode)
+				c.readCompressed = f.rsv&rsv1Bit != 0
+			}
+
+			c.fragmented = !f.fin
+			payload := f.payload
+
+			// A compressed message can only be inflated as a whole, so its
+			// fragments are collected until the final one arrives.
+			if c.readCompressed {
+				if deflatedTooLarge(len(c.deflated)+len(payload), c.readLimit) {
+					c.deflated = nil
+					return nil, false, c.fail(CloseMessageTooBig, ErrMessageTooLarge)
+				}
+
+				c.deflated = append(c.deflated, payload...)
+
+				if !f.fin {
+					continue
+				}
+
+				payload, err = decompressPayload(c.deflated, c.readLimit, c.maxDecompressionRatio)
+				c.deflated = nil
+
+				if err != nil {
+					return nil, false, c.fail(inflateCloseCode(err), err)
+				}
+			}
+
+			if c.strict && c.messageType == TextMessage && !c.checkUTF8(payload, f.fin) {
+				return nil, false, c.fail(CloseInvalidFramePayloadData, ErrInvalidUTF8)
+			}
+
+			return payload, f.fin, nil
+		case opCodePing:
+			if _, err := c.writeFrame(opCodePong, f.payload); err != nil {
+				return nil, false, err
+			}
+		case opCodePong:
+			if c.pongHandler != nil {
+				c.pongHandler(f.payload)
+			}
+		case opCodeClose:
+			return nil, false, c.handleClose(f.payload)
+		default:
+			// Control opcodes have the most significant bit set.
+			if f.opCode&0x08 == 0 {
+				return nil, false, c.fail(CloseProtocolError, ErrReservedDataOpcode)
+			}
+
+			return nil, false, c.fail(CloseProtocolError, ErrReservedControlOpcode)
+		}
+	}
+}
+
+// inflateCloseCode returns the status code failing the connection when a
+// payload cannot be inflated.
+func inflateCloseCode(err error) int {
+	if err == ErrMessageTooLarge || err == ErrDecompressionRatio {
+		return CloseMessageTooBig
+	}
+
+	return CloseProtocolError
+}
+
+// readMessageTo writes the rest of the current message to w, or the next
+// message if none is partially read, and returns its type.
+func (c *connImpl) readMessageTo(w io.Writer) (int, error) {
+	size := int64(0)
+
+	write := func(p []byte) error {
+		size += int64(len(p))
+
+		if c.readLimit > 0 && size > c.readLimit {
+			return c.fail(CloseMessageTooBig, ErrMessageTooLarge)
+		}
+
+		_, err := w.Write(p)
+
+		return err
+	}
+
+	if c.buffer != nil || c.fragmented {
+		if err := write(c.buffer); err != nil {
+			return 0, err
+		}
+
+		c.buffer = nil
+		c.shrinkReadBuffer()
+	} else {
+		payload, fin, err := c.readDataFrame()
+
+		if err != nil {
+			return 0, err
+		}
+
+		if err := write(payload); err != nil {
+			return 0, err
+		}
+
+		if fin {
+			c.shrinkReadBuffer()
+			return c.messageType, nil
+		}
+	}
+
+	for c.fragmented {
+		payload, _, err := c.readDataFrame()
+
+		if err != nil {
+			return 0, err
+		}
+
+		if err := write(payload); err != nil {
+			return 0, err
+		}
+	}
+
+	c.shrinkReadBuffer()
+
+	return c.messageType, nil
+}
+
+func (c *connImpl) ReadMessage() (int, []byte, error) {
+	buffer := getMessageBuffer()
+	defer putMessageBuffer(buffer)
+
+	messageType, err := c.readMessageTo(buffer)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return messageType, bytes.Clone(buffer.Bytes()), nil
+}
+
+func (c *connImpl) Unread(messageType int, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return ErrInvalidMessageType
+	}
+
+	if c.buffer != nil || c.fragmented {
+		return ErrReadInProgress
+	}
+
+	// The pushed back message is served as the rest of a partially read
+	// one, buffer must be non-nil even when it is empty.
+	c.buffer = append([]byte{}, data...)
+	c.messageType = messageType
+
+	return nil
+}
+
+func (c *connImpl) ReadJSON(v any) error {
+	buffer := getMessageBuffer()
+	defer putMessageBuffer(buffer)
+
+	if _, err := c.readMessageTo(buffer); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(buffer.Bytes(), v)
+}
+
+// InboundMessage is a message delivered by the Messages channel.
+type InboundMessage struct {
+	Type int
+	Data []byte
+}
+
+func (c *connImpl) Messages() <-chan InboundMessage {
+	c.messagesOnce.Do(func() {
+		c.messages = make(chan InboundMessage)
+
+		go c.readMessages()
+	})
+
+	return c.messages
+}
+
+func (c *connImpl) MessagesErr() error {
+	return c.messagesErr
+}
+
+// readMessages delivers messages on c.messages until reading fails or the
+// connection is closed.
+func (c *connImpl) readMessages() {
+	defer close(c.messages)
+
+	for {
+		messageType, data, err := c.ReadMessage()
+
+		if err != nil {
+			c.messagesErr = err
+			c.closeConn(err)
+
+			return
+		}
+
+		select {
+		case c.messages <- InboundMessage{Type: messageType, Data: data}:
+		case <-c.done:
+			c.messagesErr = net.ErrClosed
+			return
+		}
+	}
+}
+
+func (c *connImpl) SetMessageHandler(handler func(messageType int, data []byte)) {
+	c.messageHandler = handler
+}
+
+func (c *connImpl) Serve(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		c.writeClose(CloseGoingAway, "")
+		c.closeConn(ctx.Err())
+	})
+	defer stop()
+
+	for {
+		messageType, data, err := c.ReadMessage()
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err != nil {
+			c.closeConn(err)
+			return err
+		}
+
+		if c.messageHandler != nil {
+			c.messageHandler(messageType, data)
+		}
+	}
+}
+
+func (c *connImpl) ReadMessageSpooled() (int, SpooledMessage, error) {
+	w := &spoolWriter{threshold: c.spoolThreshold}
+
+	messageType, err := c.readMessageTo(w)
+
+	if err != nil {
+		w.discard()
+		return 0, nil, err
+	}
+
+	message, err := w.message()
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return messageType, message, nil
+}
+
+// frame is a single decoded websocket frame.
+type frame struct {
+	fin    bool
+	rsv    byte
+	opCode byte
+	// payload is the unmasked payload, it is only valid until the next
+	// frame is read as it shares the connection's read buffer.
+	payload []byte
+}
+
+// readFrame reads the next frame from the connection, unmasking its
+// payload if needed, as described in section 5.2 of RFC 6455.
+func (c *connImpl) readFrame() (frame, error) {
+	if c.readErr != nil {
+		return frame{}, c.readErr
+	}
+
+	if err := c.awaitFrame(); err != nil {
+		return frame{}, err
+	}
+
+	header := make([]byte, 2)
+
+	// An error before the first byte of the frame, such as a read deadline
+	// expiring while the peer is idle, leaves the stream intact and reading
+	// can be retried.
+	if n, err := io.ReadFull(c.rw, header); err != nil {
+		if n > 0 {
+			return frame{}, c.breakRead(err)
+		}
+
+		return frame{}, err
+	}
+
+	f := frame{
+		fin:    header[0]&0x80 != 0,
+		rsv:    header[0] & 0x70,
+		opCode: header[0] & 0x0F,
+	}
+
+	// Only data frames may be compressed as per section 6.1 of RFC 7692,
+	// and no negotiated extension defines the other bits for control frames.
+	if f.opCode&0x08 != 0 && f.rsv != 0 {
+		return frame{}, c.fail(CloseProtocolError, ErrCompressedControlFrame)
+	}
+
+	payloadLength := int(header[1] & 0x7F)
+
+	if payloadLength == 0x7E {
+		extended := make([]byte, 2)
+
+		if _, err := io.ReadFull(c.rw, extended); err != nil {
+			return frame{}, c.breakRead(err)
+		}
+
+		payloadLength = int(extended[0])<<0x08 | int(extended[1])
+	} else if payloadLength == 0x7F {
+		extended := make([]byte, 8)
+
+		if _, err := io.ReadFull(c.rw, extended); err != nil {
+			return frame{}, c.breakRead(err)
+		}
+
+		// The most significant bit of the 64-bit length must be 0.
+		if extended[0]&0x80 != 0 {
+			return frame{}, c.fail(CloseProtocolError, errors.New("invalid payload length"))
+		}
+
+		length := binary.BigEndian.Uint64(extended)
+
+		// Lengths that do not fit in an int, as on 32-bit platforms, could
+		// never be buffered anyway.
+		if length > math.MaxInt {
+			return frame{}, c.fail(CloseMessageTooBig, ErrFrameTooLarge)
+		}
+
+		payloadLength = int(length)
+	}
+
+	// Section 5.5 of RFC 6455 forbids fragmenting control frames and limits
+	// their payload to 125 bytes.
+	if f.opCode&0x08 != 0 {
+		if !f.fin {
+			return frame{}, c.fail(CloseProtocolError, ErrFragmentedControlFrame)
+		}
+
+		if payloadLength > maxControlPayloadLength {
+			return frame{}, c.fail(CloseProtocolError, ErrControlFrameTooLarge)
+		}
+	}
+
+	if c.readFrameLimit > 0 && int64(payloadLength) > c.readFrameLimit {
+		return frame{}, c.fail(CloseMessageTooBig, ErrFrameTooLarge)
+	}
+
+	// A frame larger than the message limit can only belong to a message
+	// exceeding it, and Read has no other way to enforce the limit.
+	if c.readLimit > 0 && int64(payloadLength) > c.readLimit {
+		return frame{}, c.fail(CloseMessageTooBig, ErrMessageTooLarge)
+	}
+
+	masked := header[1]&0x80 != 0
+
+	// Section 5.1 of RFC 6455 requires every frame sent by a client to be
+	// masked, and every frame sent by a server, control frames included,
+	// to be unmasked.
+	if !c.isClient && !masked && (!c.allowUnmasked || c.strict) {
+		return frame{}, c.fail(CloseProtocolError, ErrUnmaskedFrame)
+	}
+
+	if c.isClient && masked {
+		return frame{}, c.fail(CloseProtocolError, ErrMaskedFrame)
+	}
+
+	mask := make([]byte, 4)
+
+	if masked {
+		if _, err := io.ReadFull(c.rw, mask); err != nil {
+			return frame{}, c.breakRead(err)
+		}
+	}
+
+	payload, err := c.readPayload(payloadLength)
+
+	if err != nil {
+		return frame{}, c.breakRead(err)
+	}
+
+	f.payload = payload
+
+	if masked {
+		maskBytes(mask, f.payload)
+	}
+
+	c.hooks.frameRead(f.opCode, len(f.payload))
+	c.stats.frameRead(f.fin, f.opCode, len(f.payload))
+
+	return f, nil
+}
+
+// checkUTF8 reports whether payload continues the text message being read
+// with valid UTF-8. A character split at the end of a fragment is kept in
+// utf8Tail to be completed by the next one, and is an error on the final
+// fragment.
+func (c *connImpl) checkUTF8(payload []byte, fin bool) bool {
+	for len(c.utf8Tail) > 0 && !utf8.FullRune(c.utf8Tail) {
+		if len(payload) == 0 {
+			return !fin
+		}
+
+		c.utf8Tail = append(c.utf8Tail, payload[0])
+		payload = payload[1:]
+	}
+
+	if len(c.utf8Tail) > 0 {
+		if r, size := utf8.DecodeRune(c.utf8Tail); r == utf8.RuneError && size == 1 {
+			return false
+		}
+
+		c.utf8Tail = c.utf8Tail[:0]
+	}
+
+	// Only the last character of the payload can be incomplete, and it
+	// starts at most utf8.UTFMax-1 bytes before the end.
+	end := len(payload)
+
+	for i := len(payload) - 1; i >= 0 && i > len(payload)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(payload[i]) {
+			if !utf8.FullRune(payload[i:]) {
+				end = i
+			}
+
+			break
+		}
+	}
+
+	if !utf8.Valid(payload[:end]) {
+		return false
+	}
+
+	c.utf8Tail = append(c.utf8Tail, payload[end:]...)
+
+	return !fin || len(c.utf8Tail) == 0
+}
+
+// awaitFrame waits for the first byte of the next frame for at most the
+// frame read timeout, then restores the read deadline for the rest of the
+// frame. It returns immediately when no timeout is set or data is already
+// buffered.
+func (c *connImpl) awaitFrame() error {
+	d, ok := c.conn.(readDeadliner)
+
+	if !ok || c.rw.Reader.Buffered() > 0 {
+		return nil
+	}
+
+	c.deadlineMu.Lock()
+	timeout, readDeadline := c.frameReadTimeout, c.readDeadline
+	c.deadlineMu.Unlock()
+
+	if timeout <= 0 {
+		return nil
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	if !readDeadline.IsZero() && readDeadline.Before(deadline) {
+		deadline = readDeadline
+	}
+
+	if err := d.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+
+	_, err := c.rw.Reader.Peek(1)
+
+	// The deadline is read again as it may have been moved meanwhile.
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+
+	if restoreErr := d.SetReadDeadline(c.readDeadline); err == nil {
+		err = restoreErr
+	}
+
+	return err
+}
+
+// breakRead records err as the outcome of every later read, as it
+// interrupted a frame midway and the stream cannot be resynchronized.
+func (c *connImpl) breakRead(err error) error {
+	c.readErr = err
+	c.broken.Store(true)
+
+	return err
+}
+
+// readPayload reads a payload of the given size into the read buffer.
+// The buffer only doubles once the bytes read so far fill it, so a peer
+// announcing a huge frame makes the connection allocate no more than
+// twice what it actually sent.
+func (c *connImpl) readPayload(size int) ([]byte, error) {
+	if c.readBuf == nil && c.poolReadBuffer {
+		c.readBuf = getReadBuffer(c.readBufferSize)
+	}
+
+	if cap(c.readBuf) < c.readBufferSize {
+		c.readBuf = make([]byte, c.readBufferSize)
+	}
+
+	buf := c.readBuf[:min(size, cap(c.readBuf))]
+
+	// Once the bytes already buffered are consumed, bufio reads a payload
+	// at least as large as its buffer directly into buf, so large frames
+	// are not copied twice.
+	if _, err := io.ReadFull(c.rw, buf); err != nil {
+		return nil, err
+	}
+
+	for len(buf) < size {
+		grown := make([]byte, len(buf)+min(len(buf), size-len(buf)))
+		copy(grown, buf)
+
+		if _, err := io.ReadFull(c.rw, grown[len(buf):]); err != nil {
+			return nil, err
+		}
+
+		buf = grown
+		c.readBuf = grown
+	}
+
+	return buf, nil
+}
+
+// shrinkReadBuffer releases a read buffer that grew past readBufferSize
+// to hold a large frame, once its contents are no longer referenced.
+// Pooled buffers are returned to the pool instead.
+func (c *connImpl) shrinkReadBuffer() {
+	if c.poolReadBuffer {
+		if c.readBuf != nil {
+			putReadBuffer(c.readBuf, c.readBufferSize)
+			c.readBuf = nil
+		}
+
+		return
+	}
+
+	if cap(c.readBuf) > c.readBufferSize {
+		c.readBuf = make([]byte, c.readBufferSize)
+	}
+}
+
+// maskBytes masks or unmasks b in place with the 4 byte mask as described
+// in section 5.3 of RFC 6455, the operation being its own inverse.
+func maskBytes(mask []byte, b []byte) {
+	for i := range b {
+		b[i] ^= mask[i%4]
+	}
+}
+
+// writeClose writes a Close frame carrying the given status code and reason.
+func (c *connImpl) writeClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	payload[0] = byte(code >> 0x08)
+	payload[1] = byte(code & 0xFF)
+	payload = append(payload, reason...)
+
+	_, err := c.writeFrame(opCodeClose, payload)
+
+	if err == nil {
+		c.stats.closeCodeSent.Store(int64(code))
+	}
+
+	return err
+}
+
+// fail fails the websocket connection as described in section 7.1.7 of
+// RFC 6455: a Close frame with the given status code is sent and the
+// underlying connection is closed. Later reads return err rather than the
+// frames still buffered, so it must be called from the reading goroutine.
+// It returns err for convenience.
+func (c *connImpl) fail(code int, err error) error {
+	return c.breakRead(c.abort(code, err))
+}
+
+// abort is fail for goroutines other than the reading one, which leaves
+// the reads to notice the closed connection on their own.
+func (c *connImpl) abort(code int, err error) error {
+	c.logf("failing connection with code %d: %v", code, err)
+
+	c.writeClose(code, "")
+	c.closeConn(err)
+
+	return err
+}
+
+func (c *connImpl) Close() error {
+	// A connection closed by either side already went through the closing
+	// handshake, or failed, and must not send another Close frame.
+	select {
+	case <-c.done:
+		return c.closeConn(nil)
+	default:
+	}
+
+	code := c.defaultCloseCode
+
+	if code == 0 {
+		code = CloseNormalClosure
+	}
+
+	return c.CloseWithCode(code, "")
+}
+
+func (c *connImpl) SetDefaultCloseCode(code int) error {
+	if code != 0 && !validCloseCode(code) {
+		return ErrInvalidCloseCode
+	}
+
+	c.defaultCloseCode = code
+
+	return nil
+}
+
+func (c *connImpl) logf(format string, args ...any) {
+	if name := c.Name(); name != "" {
+		format = "[" + name + "] " + format
+	}
+
+	c.hooks.logf(format, args...)
+}
+
+func (c *connImpl) IsAlive() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+		return !c.broken.Load()
+	}
+}
+
+func (c *connImpl) Wait() error {
+	<-c.done
+
+	return c.closeReason
+}
+
+func (c *connImpl) Context() context.Context {
+	c.ctxOnce.Do(func() {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		c.ctx = ctx
+
+		go func() { cancel(c.Wait()) }()
+	})
+
+	return c.ctx
+}
+
+func (c *connImpl) CloseWithCode(code int, reason string) error {
+	if !validCloseCode(code) {
+		return ErrInvalidCloseCode
+	}
+
+	if c.truncateCloseReason {
+		reason = truncateUTF8(reason, maxCloseReasonLength)
+	}
+
+	if len(reason) > maxCloseReasonLength {
+		return ErrCloseReasonTooLong
+	}
+
+	err := c.writeClose(code, reason)
+
+	if closeErr := c.closeConn(nil); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func (c *connImpl) SetTruncateCloseReason(enabled bool) {
+	c.truncateCloseReason = enabled
+}
+
+// truncateUTF8 shortens s to at most n bytes, cutting before the rune
+// that would cross the limit rather than through it.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
+
+// closeConn closes the underlying connection once and runs the onClose
+// callbacks, whether the connection is closed by the application or
+// because of a protocol error or a Close frame from the peer. The reason
+// is recorded as the error Wait returns.
+func (c *connImpl) closeConn(reason error) error {
+	c.closeOnce.Do(func() {
+		c.flushBuffered()
+		c.closeReason = reason
+		c.closeErr = c.conn.Close()
+		close(c.done)
+
+		for _, onClose := range c.onClose {
+			onClose()
+		}
+	})
+
+	return c.closeErr
+}
+
+func (c *connImpl) SetCompressionThreshold(bytes int) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.compressionThreshold = bytes
+}
+
+func (c *connImpl) SetReadBufferSize(bytes int) error {
+	if c.buffer != nil || c.fragmented {
+		return ErrReadInProgress
+	}
+
+	if bytes <= 0 {
+		bytes = defaultReadBufferSize
+	}
+
+	c.readBufferSize = bytes
+
+	if !c.poolReadBuffer {
+		c.readBuf = make([]byte, bytes)
+	}
+
+	return nil
+}
+
+func (c *connImpl) SetWriteBufferSize(bytes int) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+
+	if bytes <= 0 {
+		bytes = defaultWriteBufferSize
+	}
+
+	if err := c.rw.Flush(); err != nil {
+		c.writeErr = err
+		c.broken.Store(true)
+
+		return err
+	}
+
+	c.rw.Writer = bufio.NewWriterSize(c.out, bytes)
+
+	return nil
+}
+
+func (c *connImpl) SetReadFrameLimit(bytes int64) {
+	c.readFrameLimit = bytes
+}
+
+func (c *connImpl) SetReadLimit(bytes int64) {
+	if bytes <= 0 {
+		bytes = defaultReadLimit
+	}
+
+	c.readLimit = bytes
+}
+
+func (c *connImpl) SetMaxFragments(n int) {
+	c.maxFragments = n
+}
+
+func (c *connImpl) SetAllowedMessageTypes(messageTypes ...int) {
+	if len(messageTypes) == 0 {
+		c.allowedTypes = nil
+		return
+	}
+
+	c.allowedTypes = slices.Clone(messageTypes)
+}
+
+func (c *connImpl) Subprotocol() string {
+	return c.subprotocol
+}
+
+func (c *connImpl) Extensions() string {
+	return c.extensions
+}
+
+func (c *connImpl) NegotiatedExtensions() []Extension {
+	if c.extensions == "" {
+		return nil
+	}
+
+	return parseExtensions([]string{c.extensions})
+}
+
+func (c *connImpl) SetUserData(data any) {
+	c.userDataMu.Lock()
+	defer c.userDataMu.Unlock()
+
+	c.userData = data
+}
+
+func (c *connImpl) UserData() any {
+	c.userDataMu.Lock()
+	defer c.userDataMu.Unlock()
+
+	return c.userData
+}
+
+func (c *connImpl) SetName(name string) {
+	c.userDataMu.Lock()
+	defer c.userDataMu.Unlock()
+
+	c.name = name
+}
+
+func (c *connImpl) Name() string {
+	c.userDataMu.Lock()
+	defer c.userDataMu.Unlock()
+
+	return c.name
+}
+
+func (c *connImpl) UnderlyingConn() net.Conn {
+	conn, _ := c.conn.(net.Conn)
+
+	return conn
+}
+
+func (c *connImpl) SetReadDeadline(t time.Time) error {
+	d, ok := c.conn.(readDeadliner)
+
+	if !ok {
+		return ErrDeadlineNotSupported
+	}
+
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+
+	c.readDeadline = t
+
+	return deadlineError(d.SetReadDeadline(t))
+}
+
+func (c *connImpl) SetFrameReadTimeout(d time.Duration) {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+
+	c.frameReadTimeout = d
+}
+
+func (c *connImpl) SetWriteDeadline(t time.Time) error {
+	d, ok := c.conn.(writeDeadliner)
+
+	if !ok {
+		return ErrDeadlineNotSupported
+	}
+
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+
+	c.writeDeadline = t
+
+	return deadlineError(d.SetWriteDeadline(t))
+}
+
+// deadlineError maps the errors transports use to signal missing deadline
+// support, such as os.ErrNoDeadline for files and pipes, to
+// ErrDeadlineNotSupported.
+func deadlineError(err error) error {
+	if errors.Is(err, os.ErrNoDeadline) || errors.Is(err, errors.ErrUnsupported) {
+		return ErrDeadlineNotSupported
+	}
+
+	return err
+}
+
+// responseCommitted reports whether the response was already written to.
+// It relies on the Written method provided by many ResponseWriter
+// wrappers, looking through the wrappers that support unwrapping like
+// http.ResponseController does, and reports false when there is none.
+func responseCommitted(w http.ResponseWriter) bool {
+	for {
+		switch t := w.(type) {
+		case interface{ Written() bool }:
+			return t.Written()
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = t.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// canHijack reports whether the connection behind w can be hijacked,
+// looking through wrappers the same way as responseCommitted. It allows
+// failing before the 101 response is sent rather than after.
+func canHijack(w http.ResponseWriter) bool {
+	for {
+		switch t := w.(type) {
+		case http.Hijacker:
+			return true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = t.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// headerListLength returns the combined length of all the values of a
+// header that may be repeated.
+func headerListLength(h http.Header, key string) int {
+	length := 0
+
+	for _, value := range h.Values(key) {
+		length += len(value)
+	}
+
+	return length
+}
+
+// parseHeaderList splits the values of a comma separated list header,
+// such as Sec-WebSocket-Protocol, into its trimmed non-empty elements.
+func parseHeaderList(values []string) []string {
+	list := make([]string, 0)
+
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			if element = strings.TrimSpace(element); element != "" {
+				list = append(list, element)
+			}
+		}
+	}
+
+	return list
+}
+
+// selectSubprotocol returns the first of the supported subprotocols that
+// was offered by the client, or an empty string if there is none.
+func selectSubprotocol(supported []string, offered []string) string {
+	for _, protocol := range supported {
+		if slices.Contains(offered, protocol) {
+			return protocol
+		}
+	}
+
+	return ""
+}
+
+// hashKey hashes a key using the SHA1 algorithm and returns the base64 encoded result.
+// It is required to hash the key provided by the client and append a predefined GUID
+// to it before encoding it to base64. This comes from the original WebSocket spec.
+//
+// The input is assembled in a stack buffer large enough for the 24 byte keys
+// clients send, so the only allocation is the returned string.
+func hashKey(key string) string {
+	var input [64]byte
+	var accept [28]byte
+
+	sum := sha1.Sum(append(append(input[:0], key...), magicWebsocketGUID...))
+	base64.StdEncoding.Encode(accept[:], sum[:])
+
+	return string(accept[:])
+}
+
+// getDataFrame returns the beginning of a final WebSocket frame with the given
+// opcode and size. Taking an int64 lets lengths above 4 GiB be encoded on
+// 32-bit platforms too, and rejecting negative sizes keeps the most
+// significant bit of the 64-bit length clear as section 5.2 of RFC 6455
+// requires. The capacity leaves room for a mask key.
+func getDataFrame(opCode byte, size int64) []byte {
+	if size < 0 {
+		panic("ws: negative frame payload length")
+	}
+
+	buffer := make([]byte, 0, 14)
 
-	buffer = append(buffer, 0x80|byte(opCodeText)&0x0F)
+	buffer = append(buffer, 0x80|opCode&0x0F)
 
 	if size <= 125 {
 		buffer = append(buffer, byte(size))
 	} else if size <= 65535 {
 		buffer = append(buffer, 126)
-		buffer = append(buffer, byte(size>>0x08))
-		buffer = append(buffer, byte(size&0xFF))
+		buffer = binary.BigEndian.AppendUint16(buffer, uint16(size))
 	} else {
 		buffer = append(buffer, 127)
-		buffer = append(buffer, byte(size>>0x38))
-		buffer = append(buffer, byte(size>>0x30))
-		buffer = append(buffer, byte(size>>0x28))
-		buffer = append(buffer, byte(size>>0x20))
-		buffer = append(buffer, byte(size>>0x18))
-		buffer = append(buffer, byte(size>>0x10))
-		buffer = append(buffer, byte(size>>0x08))
-		buffer = append(buffer, byte(size&0xFF))
+		buffer = binary.BigEndian.AppendUint64(buffer, uint64(size))
 	}
 
 	return buffer
@@ -0,0 +1,2359 @@
+package ws
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/asynched/golang-websocket-impl/internal/wstest"
+)
+
+// testConn is the transport of the connections returned by newTestConn.
+type testConn struct {
+	io.Reader
+	io.Writer
+}
+
+func (testConn) Close() error {
+	return nil
+}
+
+// newTestConn returns the server side of a connection reading the frames
+// in r and writing to w.
+func newTestConn(r io.Reader, w io.Writer) *connImpl {
+	out := &fullWriter{w: w}
+
+	return &connImpl{
+		conn:           testConn{r, w},
+		rw:             bufio.NewReadWriter(bufio.NewReader(r), bufio.NewWriter(out)),
+		out:            out,
+		readBuf:        make([]byte, defaultReadBufferSize),
+		readBufferSize: defaultReadBufferSize,
+		maxFragments:   defaultMaxFragments,
+		done:           make(chan struct{}),
+	}
+}
+
+var testMask = [4]byte{0x37, 0xfa, 0x21, 0x3d}
+
+// newTestServer starts a server upgrading every request with u and passing
+// the connection to handler, which is closed once handler returns. It
+// returns the ws:// URL of the server.
+func newTestServer(t *testing.T, u *Upgrader, handler func(conn Conn)) string {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := u.Upgrade(w, r)
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		handler(conn)
+	}))
+	t.Cleanup(srv.Close)
+
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func FuzzReadFrame(f *testing.F) {
+	const readLimit = 1 << 16
+
+	seeds := [][]byte{
+		wstest.BuildFrame(true, opCodeText, true, testMask, []byte("hello")),
+		wstest.BuildFrame(true, opCodeBinary, true, testMask, nil),
+		wstest.BuildFrame(true, opCodeBinary, true, testMask, make([]byte, 125)),
+		wstest.BuildFrame(true, opCodeBinary, true, testMask, make([]byte, 126)),
+		wstest.BuildFrame(true, opCodeBinary, true, testMask, make([]byte, 0x10000)),
+		wstest.BuildFrame(false, opCodeText, true, testMask, []byte("frag")),
+		wstest.BuildFrame(true, opCodePing, true, testMask, make([]byte, 126)),
+		wstest.BuildFrame(true, opCodeClose, true, testMask, []byte{0x03}),
+		wstest.BuildFrame(true, 0x03, true, testMask, nil),
+		wstest.BuildFrame(true, opCodeText, false, testMask, []byte("unmasked")),
+		// 64-bit lengths with the most significant bit set, or that do not
+		// fit in an int on 32-bit platforms.
+		{0x82, 0xff, 0x80, 0, 0, 0, 0, 0, 0, 0},
+		{0x82, 0xff, 0, 0, 0, 0x01, 0, 0, 0, 0},
+		// Truncated headers and payloads.
+		{0x81},
+		{0x81, 0xfe, 0x01},
+		{0x81, 0x85, 0x37, 0xfa},
+		{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 'h'},
+	}
+
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c := newTestConn(bytes.NewReader(data), io.Discard)
+		c.readLimit = readLimit
+
+		for {
+			fr, err := c.readFrame()
+
+			if err != nil {
+				return
+			}
+
+			if len(fr.payload) > readLimit {
+				t.Fatalf("read a %d byte payload beyond the %d byte limit", len(fr.payload), readLimit)
+			}
+
+			// The buffer only doubles until the payload fits.
+			if cap(c.readBuf) > 2*readLimit {
+				t.Fatalf("grew the read buffer to %d bytes", cap(c.readBuf))
+			}
+		}
+	})
+}
+
+// chunkReader returns one of its chunks per call to Read, like a transport
+// receiving a frame in separate segments.
+type chunkReader struct {
+	chunks [][]byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, r.chunks[0])
+	r.chunks[0] = r.chunks[0][n:]
+
+	if len(r.chunks[0]) == 0 {
+		r.chunks = r.chunks[1:]
+	}
+
+	return n, nil
+}
+
+func TestReadFrameSplitMask(t *testing.T) {
+	frame := wstest.BuildFrame(true, opCodeText, true, testMask, []byte("split mask"))
+
+	// The header, then the mask in two halves, then the payload.
+	r := &chunkReader{chunks: [][]byte{frame[:2], frame[2:4], frame[4:6], frame[6:]}}
+	c := newTestConn(r, io.Discard)
+
+	messageType, data, err := c.ReadMessage()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if messageType != TextMessage || string(data) != "split mask" {
+		t.Fatalf("got message %d %q", messageType, data)
+	}
+}
+
+func FuzzMaskRoundTrip(f *testing.F) {
+	for _, length := range []int{0, 1, 3, 4, 5, 7, 8, 9, 4096} {
+		f.Add(bytes.Repeat([]byte{0xa5}, length), testMask[:])
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, key []byte) {
+		if len(key) != 4 {
+			t.Skip()
+		}
+
+		masked := bytes.Clone(data)
+		maskBytes(key, masked)
+
+		for i := range data {
+			if masked[i] != data[i]^key[i%4] {
+				t.Fatalf("byte %d masked to %#x, want %#x", i, masked[i], data[i]^key[i%4])
+			}
+		}
+
+		maskBytes(key, masked)
+
+		if !bytes.Equal(masked, data) {
+			t.Fatalf("unmasking did not restore the data")
+		}
+
+		// A masked frame is unmasked in place within the read buffer.
+		c := newTestConn(bytes.NewReader(wstest.BuildFrame(true, opCodeBinary, true, [4]byte(key), data)), io.Discard)
+		fr, err := c.readFrame()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(fr.payload, data) {
+			t.Fatalf("readFrame unmasked %x, want %x", fr.payload, data)
+		}
+	})
+}
+
+func TestReadMaskedEmptyFrames(t *testing.T) {
+	in := append(
+		wstest.BuildFrame(true, opCodePing, true, testMask, nil),
+		wstest.BuildFrame(true, opCodeText, true, testMask, nil)...,
+	)
+	out := new(bytes.Buffer)
+	c := newTestConn(bytes.NewReader(in), out)
+
+	messageType, data, err := c.ReadMessage()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if messageType != TextMessage || len(data) != 0 {
+		t.Fatalf("got message %d %q, want an empty text message", messageType, data)
+	}
+
+	if pong := wstest.BuildFrame(true, opCodePong, false, [4]byte{}, nil); !bytes.Equal(out.Bytes(), pong) {
+		t.Fatalf("answered the empty ping with %x, want %x", out.Bytes(), pong)
+	}
+}
+
+func TestReadOneByteAtATime(t *testing.T) {
+	message := make([]byte, 3*defaultReadBufferSize+1)
+
+	for i := range message {
+		message[i] = byte(i)
+	}
+
+	c := newTestConn(bytes.NewReader(wstest.BuildFrame(true, opCodeBinary, true, testMask, message)), io.Discard)
+	p := make([]byte, 1)
+
+	for i := range message {
+		n, err := c.Read(p)
+
+		if err != nil || n != 1 || p[0] != message[i] {
+			t.Fatalf("read %d of %d: got %d %x %v", i, len(message), n, p[:n], err)
+		}
+	}
+
+	if c.buffer != nil {
+		t.Fatalf("%d bytes left buffered once the message was drained", len(c.buffer))
+	}
+
+	if cap(c.readBuf) > defaultReadBufferSize {
+		t.Fatalf("read buffer kept at %d bytes once the message was drained", cap(c.readBuf))
+	}
+
+	if _, err := c.Read(p); err != io.EOF {
+		t.Fatalf("got %v after the message, want io.EOF", err)
+	}
+}
+
+func TestBuildFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		fin    bool
+		opCode byte
+		length int
+	}{
+		{"empty", true, opCodeText, 0},
+		{"7-bit length", true, opCodeBinary, 125},
+		{"16-bit length", true, opCodeBinary, 126},
+		{"largest 16-bit length", false, opCodeText, 0xFFFF},
+		{"64-bit length", true, opCodeBinary, 0x10000},
+		{"continuation", true, opCodeContinuation, 10},
+		{"ping", true, opCodePing, 125},
+	}
+
+	for _, tt := range tests {
+		for _, masked := range []bool{true, false} {
+			payload := bytes.Repeat([]byte{'x'}, tt.length)
+			c := newTestConn(bytes.NewReader(wstest.BuildFrame(tt.fin, tt.opCode, masked, testMask, payload)), io.Discard)
+
+			// Servers send unmasked frames, which only clients accept.
+			c.isClient = !masked
+
+			fr, err := c.readFrame()
+
+			if err != nil {
+				t.Fatalf("%s, masked %v: %v", tt.name, masked, err)
+			}
+
+			if fr.fin != tt.fin || fr.opCode != tt.opCode || fr.rsv != 0 || !bytes.Equal(fr.payload, payload) {
+				t.Fatalf("%s, masked %v: got fin %v opcode %#x rsv %#x and %d bytes", tt.name, masked, fr.fin, fr.opCode, fr.rsv, len(fr.payload))
+			}
+		}
+	}
+}
+
+func TestReadPayloadDeliveredWithEOF(t *testing.T) {
+	frame := wstest.BuildFrame(true, opCodeText, true, testMask, []byte("last bytes"))
+
+	// The final chunk of the frame arrives together with io.EOF.
+	r := iotest.DataErrReader(&chunkReader{chunks: [][]byte{frame[:8], frame[8:]}})
+	c := newTestConn(r, io.Discard)
+
+	messageType, data, err := c.ReadMessage()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if messageType != TextMessage || string(data) != "last bytes" {
+		t.Fatalf("got message %d %q", messageType, data)
+	}
+
+	if _, _, err := c.ReadMessage(); err != io.EOF {
+		t.Fatalf("got %v after the message, want io.EOF", err)
+	}
+}
+
+func TestReadHugeDeclaredLength(t *testing.T) {
+	// A binary frame announcing 2^48 bytes of which only a few arrive.
+	sent := 3*defaultReadBufferSize + 1
+	in := append([]byte{0x82, 0xff, 0, 0x01, 0, 0, 0, 0, 0, 0}, testMask[:]...)
+	in = append(in, make([]byte, sent)...)
+
+	c := newTestConn(bytes.NewReader(in), io.Discard)
+
+	if _, err := c.readFrame(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v, want io.ErrUnexpectedEOF", err)
+	}
+
+	if cap(c.readBuf) > 2*sent {
+		t.Fatalf("grew the read buffer to %d bytes for %d bytes received", cap(c.readBuf), sent)
+	}
+}
+
+func TestReadOversizedFrameStreaming(t *testing.T) {
+	// Only the header of a 1 MiB frame is sent, as the limit must be
+	// enforced before its payload is read.
+	in := append([]byte{0x82, 0xff, 0, 0, 0, 0, 0, 0x10, 0, 0}, testMask[:]...)
+	out := new(bytes.Buffer)
+	c := newTestConn(bytes.NewReader(in), out)
+	c.SetReadLimit(1024)
+
+	if _, err := c.Read(make([]byte, 16)); err != ErrMessageTooLarge {
+		t.Fatalf("got %v, want ErrMessageTooLarge", err)
+	}
+
+	if cap(c.readBuf) != defaultReadBufferSize {
+		t.Fatalf("grew the read buffer to %d bytes", cap(c.readBuf))
+	}
+
+	if closeFrame := wstest.BuildFrame(true, opCodeClose, false, [4]byte{}, []byte{0x03, 0xf1}); !bytes.Equal(out.Bytes(), closeFrame) {
+		t.Fatalf("wrote %x, want the close frame %x", out.Bytes(), closeFrame)
+	}
+}
+
+func TestSetReadLimitDefault(t *testing.T) {
+	c := newTestConn(bytes.NewReader(nil), io.Discard)
+
+	for _, limit := range []int64{0, -1} {
+		c.SetReadLimit(limit)
+
+		if c.readLimit != defaultReadLimit {
+			t.Fatalf("SetReadLimit(%d) set the limit to %d, want %d", limit, c.readLimit, defaultReadLimit)
+		}
+	}
+}
+
+func TestControlFrameRules(t *testing.T) {
+	frames := map[string][]byte{
+		"fragmented ping": wstest.BuildFrame(false, opCodePing, true, testMask, nil),
+		"oversized ping":  wstest.BuildFrame(true, opCodePing, true, testMask, make([]byte, maxControlPayloadLength+1)),
+		"oversized close": wstest.BuildFrame(true, opCodeClose, true, testMask, make([]byte, maxControlPayloadLength+1)),
+	}
+
+	// Control frames are checked whether or not strict mode is enabled.
+	for _, strict := range []bool{false, true} {
+		for name, in := range frames {
+			out := new(bytes.Buffer)
+			c := newTestConn(bytes.NewReader(in), out)
+			c.strict = strict
+
+			if _, _, err := c.ReadMessage(); err != ErrFragmentedControlFrame && err != ErrControlFrameTooLarge {
+				t.Fatalf("%s, strict %v: got %v", name, strict, err)
+			}
+
+			if want := closeFrame(CloseProtocolError, ""); !bytes.Equal(out.Bytes(), want) {
+				t.Fatalf("%s, strict %v: wrote %x, want %x", name, strict, out.Bytes(), want)
+			}
+		}
+	}
+}
+
+func TestStrictModeUTF8(t *testing.T) {
+	invalid := []byte{'a', 0xff, 'b'}
+	in := append(
+		wstest.BuildFrame(true, opCodeText, true, testMask, invalid),
+		wstest.BuildFrame(true, opCodeClose, true, testMask, append([]byte{0x03, 0xe8}, invalid...))...,
+	)
+
+	// Outside strict mode the text message and the close reason are
+	// delivered as is.
+	c := newTestConn(bytes.NewReader(in), io.Discard)
+
+	if _, data, err := c.ReadMessage(); err != nil || !bytes.Equal(data, invalid) {
+		t.Fatalf("lenient: got %x %v, want the invalid text message", data, err)
+	}
+
+	if _, _, err := c.ReadMessage(); !isCloseError(err, CloseNormalClosure, string(invalid)) {
+		t.Fatalf("lenient: got %v, want the close reason as is", err)
+	}
+
+	out := new(bytes.Buffer)
+	c = newTestConn(bytes.NewReader(in), out)
+	c.strict = true
+
+	if _, _, err := c.ReadMessage(); err != ErrInvalidUTF8 {
+		t.Fatalf("strict: got %v, want ErrInvalidUTF8", err)
+	}
+
+	if want := closeFrame(CloseInvalidFramePayloadData, ""); !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("strict: wrote %x, want %x", out.Bytes(), want)
+	}
+}
+
+// writtenResponseWriter is a middleware wrapper reporting whether the
+// response was written to.
+type writtenResponseWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *writtenResponseWriter) WriteHeader(status int) {
+	w.written = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *writtenResponseWriter) Write(p []byte) (int, error) {
+	w.written = true
+
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *writtenResponseWriter) Written() bool {
+	return w.written
+}
+
+func (w *writtenResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func TestUpgradeResponseAlreadyCommitted(t *testing.T) {
+	for _, writeFirst := range []bool{false, true} {
+		upgraded := make(chan error, 1)
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ww := &writtenResponseWriter{ResponseWriter: w}
+
+			if writeFirst {
+				ww.Write([]byte("too early"))
+			}
+
+			conn, err := (&Upgrader{}).Upgrade(ww, r)
+			upgraded <- err
+
+			if err == nil {
+				conn.Close()
+			}
+		}))
+
+		conn, dialErr := Dial("ws" + strings.TrimPrefix(srv.URL, "http"))
+
+		if err := <-upgraded; writeFirst && err != ErrResponseAlreadyCommitted || !writeFirst && err != nil {
+			t.Fatalf("writing first %v: Upgrade returned %v", writeFirst, err)
+		}
+
+		if writeFirst != (dialErr != nil) {
+			t.Fatalf("writing first %v: Dial returned %v", writeFirst, dialErr)
+		}
+
+		if conn != nil {
+			conn.Close()
+		}
+
+		srv.Close()
+	}
+}
+
+func TestGetDataFrameLengths(t *testing.T) {
+	tests := []struct {
+		size int64
+		want []byte
+	}{
+		{0, []byte{0x82, 0}},
+		{125, []byte{0x82, 125}},
+		{126, []byte{0x82, 126, 0, 126}},
+		{65535, []byte{0x82, 126, 0xff, 0xff}},
+		{65536, []byte{0x82, 127, 0, 0, 0, 0, 0, 0x01, 0, 0}},
+		{100000, []byte{0x82, 127, 0, 0, 0, 0, 0, 0x01, 0x86, 0xa0}},
+		{0x0123456789abcdef, []byte{0x82, 127, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}},
+		{math.MaxInt64, []byte{0x82, 127, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	}
+
+	for _, tt := range tests {
+		if got := getDataFrame(opCodeBinary, tt.size); !bytes.Equal(got, tt.want) {
+			t.Fatalf("getDataFrame(%d) = %x, want %x", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestGetDataFrameNegativeSize(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("getDataFrame accepted a negative size")
+		}
+	}()
+
+	getDataFrame(opCodeBinary, -1)
+}
+
+// newHandshakeRequest returns a valid opening handshake request.
+func newHandshakeRequest() *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+	return r
+}
+
+func TestUpgradeMaxSubprotocols(t *testing.T) {
+	tests := []struct {
+		name    string
+		max     int
+		offered int
+		want    error
+	}{
+		{"default", 0, 1000, ErrTooManySubprotocols},
+		{"default limit", 0, defaultMaxSubprotocols, ErrHijackNotSupported},
+		{"lower limit", 2, 3, ErrTooManySubprotocols},
+		{"higher limit", 1000, 1000, ErrHijackNotSupported},
+	}
+
+	for _, tt := range tests {
+		r := newHandshakeRequest()
+		r.Header.Set("Sec-WebSocket-Protocol", strings.Repeat("p,", tt.offered-1)+"p")
+		w := httptest.NewRecorder()
+
+		// The recorder cannot be hijacked, so handshakes within the limit
+		// fail at the next step.
+		if _, err := (&Upgrader{MaxSubprotocols: tt.max}).Upgrade(w, r); err != tt.want {
+			t.Fatalf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+
+		if tt.want == ErrTooManySubprotocols && w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: got status %d, want %d", tt.name, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// noDeadlineConn is a transport whose deadline methods fail the way files
+// and pipes do.
+type noDeadlineConn struct {
+	testConn
+}
+
+func (noDeadlineConn) SetReadDeadline(time.Time) error {
+	return os.ErrNoDeadline
+}
+
+func (noDeadlineConn) SetWriteDeadline(time.Time) error {
+	return fmt.Errorf("set deadline: %w", errors.ErrUnsupported)
+}
+
+func TestDeadlineNotSupported(t *testing.T) {
+	withoutMethods := newTestConn(bytes.NewReader(nil), io.Discard)
+	failingMethods := newTestConn(bytes.NewReader(nil), io.Discard)
+	failingMethods.conn = noDeadlineConn{}
+
+	for name, c := range map[string]*connImpl{"without methods": withoutMethods, "failing methods": failingMethods} {
+		deadline := time.Now().Add(time.Second)
+
+		if err := c.SetReadDeadline(deadline); err != ErrDeadlineNotSupported {
+			t.Fatalf("%s: SetReadDeadline returned %v", name, err)
+		}
+
+		if err := c.SetWriteDeadline(deadline); err != ErrDeadlineNotSupported {
+			t.Fatalf("%s: SetWriteDeadline returned %v", name, err)
+		}
+
+		if err := c.WriteMessageWithDeadline(TextMessage, nil, deadline); err != ErrDeadlineNotSupported {
+			t.Fatalf("%s: WriteMessageWithDeadline returned %v", name, err)
+		}
+	}
+}
+
+// readFailure reads a message from a server connection receiving in, and
+// returns the status code of the Close frame it answered with, or zero if
+// it sent none, along with the read error.
+func readFailure(in []byte) (int, error) {
+	out := new(bytes.Buffer)
+	c := newTestConn(bytes.NewReader(in), out)
+	_, _, err := c.ReadMessage()
+
+	b := out.Bytes()
+
+	if len(b) < 4 || b[0] != 0x88 {
+		return 0, err
+	}
+
+	return int(b[2])<<8 | int(b[3]), err
+}
+
+func TestReadStrayContinuation(t *testing.T) {
+	code, err := readFailure(wstest.BuildFrame(true, opCodeContinuation, true, testMask, []byte("stray")))
+
+	if code != CloseProtocolError || err != ErrUnexpectedContinuation {
+		t.Fatalf("got code %d and %v, want %d and ErrUnexpectedContinuation", code, err, CloseProtocolError)
+	}
+}
+
+func TestReadReservedOpcodes(t *testing.T) {
+	for opCode := byte(0x3); opCode <= 0xF; opCode++ {
+		want := ErrReservedDataOpcode
+
+		switch {
+		case opCode >= 0x8 && opCode <= 0xA:
+			continue
+		case opCode > 0xA:
+			want = ErrReservedControlOpcode
+		}
+
+		code, err := readFailure(wstest.BuildFrame(true, opCode, true, testMask, nil))
+
+		if code != CloseProtocolError || err != want {
+			t.Fatalf("opcode %#x: got code %d and %v, want %d and %v", opCode, code, err, CloseProtocolError, want)
+		}
+	}
+}
+
+func TestReadBufferGrowth(t *testing.T) {
+	const large = 100000
+
+	in := append(
+		wstest.BuildFrame(true, opCodeBinary, true, testMask, make([]byte, large)),
+		wstest.BuildFrame(true, opCodeBinary, true, testMask, make([]byte, 10))...,
+	)
+	c := newTestConn(bytes.NewReader(in), io.Discard)
+
+	if _, err := c.readFrame(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := cap(c.readBuf); n < large || n > 2*large {
+		t.Fatalf("read buffer grew to %d bytes for a %d byte frame", n, large)
+	}
+
+	// Once the large frame is consumed, small ones fit the initial size.
+	c.shrinkReadBuffer()
+
+	if _, err := c.readFrame(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := cap(c.readBuf); n != defaultReadBufferSize {
+		t.Fatalf("read buffer is %d bytes after a small frame, want %d", n, defaultReadBufferSize)
+	}
+}
+
+func TestUpgraderReadBufferSize(t *testing.T) {
+	sizes := make(chan int, 1)
+
+	url := newTestServer(t, &Upgrader{ReadBufferSize: 512}, func(conn Conn) {
+		sizes <- cap(conn.(*connImpl).readBuf)
+	})
+
+	conn, err := Dial(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	if n := <-sizes; n != 512 {
+		t.Fatalf("server read buffer is %d bytes, want 512", n)
+	}
+}
+
+func TestWriteMessageWithDeadline(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	c := newTestConn(server, server)
+	c.conn = server
+
+	// Nothing reads from the pipe, so the write cannot complete.
+	err := c.WriteMessageWithDeadline(TextMessage, []byte("stuck"), time.Now().Add(20*time.Millisecond))
+
+	if !isTimeout(err) {
+		t.Fatalf("got %v from a peer not reading, want a timeout", err)
+	}
+
+	// Later writes are not bound by the deadline, and succeed once the
+	// peer reads again.
+	received := make(chan []byte, 1)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+
+		frame := make([]byte, 7)
+		io.ReadFull(client, frame)
+		received <- frame
+	}()
+
+	if err := c.WriteMessage(TextMessage, []byte("later")); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := wstest.BuildFrame(true, opCodeText, false, [4]byte{}, []byte("later")); !bytes.Equal(<-received, want) {
+		t.Fatalf("peer did not receive the later message intact")
+	}
+}
+
+// echo writes back every message conn reads until reading fails.
+func echo(conn Conn) {
+	for {
+		messageType, data, err := conn.ReadMessage()
+
+		if err != nil {
+			return
+		}
+
+		if err := conn.WriteMessage(messageType, data); err != nil {
+			return
+		}
+	}
+}
+
+func TestForwardTo(t *testing.T) {
+	upstreamURL := newTestServer(t, &Upgrader{}, echo)
+
+	proxyURL := newTestServer(t, &Upgrader{}, func(downstream Conn) {
+		upstream, err := Dial(upstreamURL)
+
+		if err != nil {
+			return
+		}
+
+		defer upstream.Close()
+
+		go func() {
+			for upstream.ForwardTo(downstream) == nil {
+			}
+		}()
+
+		for downstream.ForwardTo(upstream) == nil {
+		}
+	})
+
+	conn, err := Dial(proxyURL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	messages := [][]byte{[]byte("hello"), bytes.Repeat([]byte{0xab}, 70000), nil}
+
+	for _, data := range messages {
+		if err := conn.WriteMessage(BinaryMessage, data); err != nil {
+			t.Fatal(err)
+		}
+
+		messageType, got, err := conn.ReadMessage()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if messageType != BinaryMessage || !bytes.Equal(got, data) {
+			t.Fatalf("got a %d byte message of type %d back, want the %d bytes sent", len(got), messageType, len(data))
+		}
+	}
+
+	// A ping crosses the proxy as well, and is answered by the server.
+	pong := make(chan []byte, 1)
+	conn.SetPongHandler(func(data []byte) { pong <- bytes.Clone(data) })
+
+	if err := conn.PingWithData([]byte("through")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.WriteMessage(TextMessage, []byte("after ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "after ping" {
+		t.Fatalf("got %q %v after the ping", data, err)
+	}
+
+	if data := <-pong; string(data) != "through" {
+		t.Fatalf("got pong %q, want the ping payload", data)
+	}
+}
+
+func TestReadFragmentSequence(t *testing.T) {
+	tests := []struct {
+		name string
+		in   [][]byte
+		want error
+	}{
+		{
+			"lone continuation",
+			[][]byte{wstest.BuildFrame(true, opCodeContinuation, true, testMask, []byte("lone"))},
+			ErrUnexpectedContinuation,
+		},
+		{
+			"text within a fragmented text message",
+			[][]byte{
+				wstest.BuildFrame(false, opCodeText, true, testMask, []byte("first")),
+				wstest.BuildFrame(true, opCodeText, true, testMask, []byte("second")),
+			},
+			ErrExpectedContinuation,
+		},
+		{
+			"continuation after the final fragment",
+			[][]byte{
+				wstest.BuildFrame(false, opCodeText, true, testMask, []byte("first")),
+				wstest.BuildFrame(true, opCodeContinuation, true, testMask, []byte("last")),
+				wstest.BuildFrame(true, opCodeContinuation, true, testMask, []byte("extra")),
+			},
+			ErrUnexpectedContinuation,
+		},
+	}
+
+	for _, tt := range tests {
+		out := new(bytes.Buffer)
+		c := newTestConn(bytes.NewReader(bytes.Join(tt.in, nil)), out)
+
+		var err error
+
+		for err == nil {
+			_, _, err = c.ReadMessage()
+		}
+
+		if err != tt.want {
+			t.Fatalf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+
+		if want := closeFrame(CloseProtocolError, ""); !bytes.Equal(out.Bytes(), want) {
+			t.Fatalf("%s: wrote %x, want %x", tt.name, out.Bytes(), want)
+		}
+	}
+}
+
+func TestReadFrameLimit(t *testing.T) {
+	// Frames within the frame limit make up a message larger than it.
+	in := append(
+		wstest.BuildFrame(false, opCodeBinary, true, testMask, make([]byte, 100)),
+		wstest.BuildFrame(true, opCodeContinuation, true, testMask, make([]byte, 100))...,
+	)
+	// A single frame over the frame limit but within the message limit,
+	// of which only the header is sent.
+	in = append(in, 0x82, 0xfe, 0x01, 0x00)
+	in = append(in, testMask[:]...)
+
+	out := new(bytes.Buffer)
+	c := newTestConn(bytes.NewReader(in), out)
+	c.SetReadFrameLimit(128)
+	c.SetReadLimit(1024)
+
+	if _, data, err := c.ReadMessage(); err != nil || len(data) != 200 {
+		t.Fatalf("got %d bytes and %v, want the fragmented message", len(data), err)
+	}
+
+	if _, _, err := c.ReadMessage(); err != ErrFrameTooLarge {
+		t.Fatalf("got %v, want ErrFrameTooLarge", err)
+	}
+
+	if want := closeFrame(CloseMessageTooBig, ""); !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("wrote %x, want %x", out.Bytes(), want)
+	}
+}
+
+func TestWriteTextAndBinary(t *testing.T) {
+	out := new(bytes.Buffer)
+	c := newTestConn(bytes.NewReader(nil), out)
+
+	if err := c.WriteText([]byte("text")); err != nil {
+		t.Fatal(err)
+	}
+
+	if opCode := out.Bytes()[0] & 0x0F; opCode != opCodeText {
+		t.Fatalf("WriteText sent opcode %#x", opCode)
+	}
+
+	out.Reset()
+
+	if err := c.WriteBinary([]byte{0xff}); err != nil {
+		t.Fatal(err)
+	}
+
+	if opCode := out.Bytes()[0] & 0x0F; opCode != opCodeBinary {
+		t.Fatalf("WriteBinary sent opcode %#x", opCode)
+	}
+
+	invalid := []byte{'a', 0xff}
+	out.Reset()
+
+	// Invalid UTF-8 is only rejected once validation is enabled.
+	if err := c.WriteText(invalid); err != nil {
+		t.Fatal(err)
+	}
+
+	out.Reset()
+	c.SetValidateUTF8(true)
+
+	if err := c.WriteText(invalid); err != ErrInvalidUTF8 {
+		t.Fatalf("got %v, want ErrInvalidUTF8", err)
+	}
+
+	if out.Len() != 0 {
+		t.Fatalf("wrote %x for a rejected message", out.Bytes())
+	}
+}
+
+func TestHandshakeHeaderTooLarge(t *testing.T) {
+	longList := strings.Repeat("x", maxHeaderListLength/2) + ", " + strings.Repeat("y", maxHeaderListLength/2)
+
+	tests := []struct {
+		header string
+		value  string
+	}{
+		{"Sec-WebSocket-Key", strings.Repeat("k", maxKeyLength+1)},
+		{"Sec-WebSocket-Protocol", longList},
+		{"Sec-WebSocket-Extensions", longList},
+	}
+
+	for _, tt := range tests {
+		r := newHandshakeRequest()
+		r.Header.Set(tt.header, tt.value)
+		w := httptest.NewRecorder()
+
+		if _, err := (&Upgrader{}).Upgrade(w, r); err != ErrHandshakeHeaderTooLarge {
+			t.Fatalf("%s: got %v, want ErrHandshakeHeaderTooLarge", tt.header, err)
+		}
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: got status %d, want %d", tt.header, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	// The limit applies to all the lines of a header together.
+	r := newHandshakeRequest()
+
+	for range 3 {
+		r.Header.Add("Sec-WebSocket-Protocol", strings.Repeat("p", maxHeaderListLength/2))
+	}
+
+	if _, err := CheckHandshake(r); err != ErrHandshakeHeaderTooLarge {
+		t.Fatalf("got %v for a list split over several lines, want ErrHandshakeHeaderTooLarge", err)
+	}
+}
+
+func TestUnderlyingConn(t *testing.T) {
+	remoteAddrs := make(chan string, 1)
+
+	url := newTestServer(t, &Upgrader{}, func(conn Conn) {
+		remoteAddrs <- conn.UnderlyingConn().RemoteAddr().String()
+	})
+
+	var dialed net.Conn
+
+	d := &Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			dialed = conn
+
+			return conn, err
+		},
+	}
+
+	conn, err := d.DialContext(context.Background(), url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	if conn.UnderlyingConn() != dialed {
+		t.Fatal("client connection does not return the dialed net.Conn")
+	}
+
+	// The server side returns the hijacked connection, whose peer is the
+	// dialed one.
+	if addr := <-remoteAddrs; addr != dialed.LocalAddr().String() {
+		t.Fatalf("server connection is from %s, want %s", addr, dialed.LocalAddr())
+	}
+}
+
+func TestWaitForDrain(t *testing.T) {
+	u := &Upgrader{}
+	url := newTestServer(t, u, echo)
+
+	var conns []Conn
+
+	for range 3 {
+		conn, err := Dial(url)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conns = append(conns, conn)
+	}
+
+	if n := u.ActiveConnections(); n != 3 {
+		t.Fatalf("%d active connections, want 3", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := u.WaitForDrain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v with connections open, want context.DeadlineExceeded", err)
+	}
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := u.WaitForDrain(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := u.ActiveConnections(); n != 0 {
+		t.Fatalf("%d active connections once drained", n)
+	}
+}
+
+func TestMessages(t *testing.T) {
+	url := newTestServer(t, &Upgrader{}, func(conn Conn) {
+		for _, data := range []string{"one", "two", "three"} {
+			conn.WriteMessage(TextMessage, []byte(data))
+		}
+
+		conn.ReadMessage()
+	})
+
+	conn, err := Dial(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := conn.Messages()
+
+	for _, want := range []string{"one", "two", "three"} {
+		if msg := <-messages; msg.Type != TextMessage || string(msg.Data) != want {
+			t.Fatalf("got message %d %q, want %q", msg.Type, msg.Data, want)
+		}
+	}
+
+	// Closing the connection ends the goroutine, which closes the channel.
+	conn.Close()
+
+	select {
+	case msg, ok := <-messages:
+		if ok {
+			t.Fatalf("got message %q after Close", msg.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel still open after Close")
+	}
+
+	if conn.MessagesErr() == nil {
+		t.Fatal("MessagesErr is nil once the channel is closed")
+	}
+}
+
+// doHandshake sends the request of newHandshakeRequest with the extra
+// headers to the server at the ws:// URL and returns its response.
+func doHandshake(t *testing.T, url string, extra http.Header) *http.Response {
+	t.Helper()
+
+	r := newHandshakeRequest()
+	r.RequestURI = ""
+	r.URL, _ = r.URL.Parse("http" + strings.TrimPrefix(url, "ws"))
+	r.Host = r.URL.Host
+
+	for key, values := range extra {
+		r.Header.Del(key)
+
+		for _, value := range values {
+			r.Header.Add(key, value)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(r)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { resp.Body.Close() })
+
+	return resp
+}
+
+func TestCheckExtensions(t *testing.T) {
+	compressed := make(chan bool, 1)
+
+	u := &Upgrader{
+		EnableCompression: true,
+		CheckExtensions: func(r *http.Request, offered string, accepted string) string {
+			if strings.Contains(r.UserAgent(), "BuggyClient") {
+				return ""
+			}
+
+			return accepted
+		},
+	}
+	url := newTestServer(t, u, func(conn Conn) {
+		compressed <- conn.CompressionEnabled()
+	})
+
+	for _, userAgent := range []string{"GoodClient/1.0", "BuggyClient/2.3"} {
+		resp := doHandshake(t, url, http.Header{
+			"User-Agent":               {userAgent},
+			"Sec-WebSocket-Extensions": {"permessage-deflate"},
+		})
+
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("%s: got status %s", userAgent, resp.Status)
+		}
+
+		want := !strings.HasPrefix(userAgent, "Buggy")
+
+		if got := resp.Header.Get("Sec-WebSocket-Extensions") != ""; got != want {
+			t.Fatalf("%s: extensions accepted %v, want %v", userAgent, got, want)
+		}
+
+		if got := <-compressed; got != want {
+			t.Fatalf("%s: compression enabled %v, want %v", userAgent, got, want)
+		}
+	}
+}
+
+func TestPingEmpty(t *testing.T) {
+	out := new(bytes.Buffer)
+	c := newTestConn(bytes.NewReader(nil), out)
+
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []byte{0x89, 0x00}; !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("wrote %x, want %x", out.Bytes(), want)
+	}
+
+	// The peer answers with an empty pong, delivered to the pong handler
+	// while reading.
+	url := newTestServer(t, &Upgrader{}, echo)
+	conn, err := Dial(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	pongs := make(chan []byte, 1)
+	conn.SetPongHandler(func(data []byte) { pongs <- bytes.Clone(data) })
+
+	if err := conn.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.WriteMessage(TextMessage, []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case data := <-pongs:
+		if len(data) != 0 {
+			t.Fatalf("got pong %q, want an empty one", data)
+		}
+	default:
+		t.Fatal("no pong received before the echoed message")
+	}
+}
+
+func TestUserData(t *testing.T) {
+	c := newTestConn(bytes.NewReader(nil), io.Discard)
+
+	if data := c.UserData(); data != nil {
+		t.Fatalf("got %v before any was set", data)
+	}
+
+	type session struct{ user string }
+
+	c.SetUserData(&session{user: "alice"})
+
+	if s, ok := c.UserData().(*session); !ok || s.user != "alice" {
+		t.Fatalf("got %v, want the session set", c.UserData())
+	}
+}
+
+func TestWriteEmpty(t *testing.T) {
+	for _, p := range [][]byte{nil, {}} {
+		out := new(bytes.Buffer)
+		c := newTestConn(bytes.NewReader(nil), out)
+
+		if n, err := c.Write(p); n != 0 || err != nil {
+			t.Fatalf("Write(%#v) returned %d, %v", p, n, err)
+		}
+
+		if want := []byte{0x81, 0x00}; !bytes.Equal(out.Bytes(), want) {
+			t.Fatalf("Write(%#v) wrote %x, want %x", p, out.Bytes(), want)
+		}
+	}
+}
+
+func BenchmarkWriteMessageSmall(b *testing.B) {
+	c := newTestConn(bytes.NewReader(nil), io.Discard)
+	data := []byte("a small message")
+
+	b.ReportAllocs()
+
+	for range b.N {
+		if err := c.WriteMessage(TextMessage, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestWriteMessageSmallAllocs(t *testing.T) {
+	data := []byte("a small message")
+
+	// Clients mask their frames, which must not allocate either.
+	for _, isClient := range []bool{false, true} {
+		c := newTestConn(bytes.NewReader(nil), io.Discard)
+		c.isClient = isClient
+
+		allocs := testing.AllocsPerRun(100, func() {
+			c.WriteMessage(TextMessage, data)
+		})
+
+		if allocs != 0 {
+			t.Fatalf("client %v: WriteMessage of a small message allocates %v times", isClient, allocs)
+		}
+	}
+}
+
+func TestServe(t *testing.T) {
+	in := bytes.Join([][]byte{
+		wstest.BuildFrame(true, opCodeText, true, testMask, []byte("one")),
+		wstest.BuildFrame(true, opCodePing, true, testMask, nil),
+		wstest.BuildFrame(false, opCodeBinary, true, testMask, []byte("tw")),
+		wstest.BuildFrame(true, opCodeContinuation, true, testMask, []byte("o")),
+		wstest.BuildFrame(true, opCodeText, true, testMask, []byte("three")),
+		wstest.BuildFrame(true, opCodeClose, true, testMask, []byte{0x03, 0xe8}),
+	}, nil)
+
+	c := newTestConn(bytes.NewReader(in), io.Discard)
+
+	var delivered []string
+
+	c.SetMessageHandler(func(messageType int, data []byte) {
+		delivered = append(delivered, string(data))
+	})
+
+	if err := c.Serve(context.Background()); !isCloseError(err, CloseNormalClosure, "") {
+		t.Fatalf("Serve returned %v, want the peer's *CloseError", err)
+	}
+
+	if want := []string{"one", "two", "three"}; !slices.Equal(delivered, want) {
+		t.Fatalf("handler received %q, want %q", delivered, want)
+	}
+}
+
+func TestCheckHandshake(t *testing.T) {
+	r := newHandshakeRequest()
+	r.Header.Set("Sec-WebSocket-Protocol", "chat, superchat")
+	r.Header.Add("Sec-WebSocket-Extensions", "permessage-deflate")
+	r.Header.Add("Sec-WebSocket-Extensions", "x-custom")
+	r.Header.Set("Origin", "https://example.com")
+
+	info, err := CheckHandshake(r)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := HandshakeInfo{
+		Key:          "dGhlIHNhbXBsZSBub25jZQ==",
+		Subprotocols: []string{"chat", "superchat"},
+		Extensions:   "permessage-deflate, x-custom",
+		Origin:       "https://example.com",
+	}
+
+	if info.Key != want.Key || !slices.Equal(info.Subprotocols, want.Subprotocols) || info.Extensions != want.Extensions || info.Origin != want.Origin {
+		t.Fatalf("got %+v, want %+v", info, want)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(r *http.Request)
+		want   error
+	}{
+		{"POST", func(r *http.Request) { r.Method = http.MethodPost }, ErrBadMethod},
+		{"draft keys", func(r *http.Request) { r.Header.Set("Sec-WebSocket-Key1", "1 2") }, ErrUnsupportedDraftHandshake},
+		{"no connection", func(r *http.Request) { r.Header.Del("Connection") }, nil},
+		{"no upgrade", func(r *http.Request) { r.Header.Del("Upgrade") }, nil},
+		{"version 8", func(r *http.Request) { r.Header.Set("Sec-WebSocket-Version", "8") }, ErrUnsupportedVersion},
+		{"no key", func(r *http.Request) { r.Header.Del("Sec-WebSocket-Key") }, nil},
+		{"long key", func(r *http.Request) { r.Header.Set("Sec-WebSocket-Key", strings.Repeat("k", maxKeyLength+1)) }, ErrHandshakeHeaderTooLarge},
+	}
+
+	for _, tt := range tests {
+		r := newHandshakeRequest()
+		tt.modify(r)
+
+		_, err := CheckHandshake(r)
+
+		// Variants without a dedicated error only need to fail.
+		if err == nil || tt.want != nil && err != tt.want {
+			t.Fatalf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestCheckHandshakeKeyWhitespace(t *testing.T) {
+	r := newHandshakeRequest()
+	r.Header["Sec-Websocket-Key"] = []string{"dGhlIHNhbXBsZSBub25jZQ== \t"}
+
+	info, err := CheckHandshake(r)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if accept := hashKey(info.Key); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("got accept value %s for a key with trailing whitespace", accept)
+	}
+}
+
+func TestReadCopyUntilClose(t *testing.T) {
+	url := newTestServer(t, &Upgrader{}, func(conn Conn) {
+		conn.WriteMessage(BinaryMessage, []byte("streamed "))
+		conn.WriteMessage(BinaryMessage, []byte("data"))
+		conn.CloseWithCode(CloseNormalClosure, "")
+	})
+
+	conn, err := Dial(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	var buf bytes.Buffer
+
+	if _, err := io.Copy(&buf, conn); err != nil {
+		t.Fatalf("io.Copy returned %v on a clean close", err)
+	}
+
+	if buf.String() != "streamed data" {
+		t.Fatalf("copied %q", buf.String())
+	}
+}
+
+// trickleWriter accepts at most n bytes per call to Write, reporting the
+// short write without an error like some transports do.
+type trickleWriter struct {
+	bytes.Buffer
+	n int
+}
+
+func (w *trickleWriter) Write(p []byte) (int, error) {
+	return w.Buffer.Write(p[:min(len(p), w.n)])
+}
+
+func TestWriteShortWrites(t *testing.T) {
+	out := &trickleWriter{n: 3}
+	c := newTestConn(bytes.NewReader(nil), out)
+
+	small := []byte("small")
+	large := bytes.Repeat([]byte("large "), 2000)
+
+	if err := c.WriteMessage(TextMessage, small); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.WriteMessage(BinaryMessage, large); err != nil {
+		t.Fatal(err)
+	}
+
+	want := append(
+		wstest.BuildFrame(true, opCodeText, false, [4]byte{}, small),
+		wstest.BuildFrame(true, opCodeBinary, false, [4]byte{}, large)...,
+	)
+
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("frames written in %d byte chunks were corrupted", out.n)
+	}
+}
+
+func TestUpgradeDraftHandshake(t *testing.T) {
+	r := newHandshakeRequest()
+	r.Header.Del("Sec-WebSocket-Key")
+	r.Header.Del("Sec-WebSocket-Version")
+	r.Header.Set("Sec-WebSocket-Key1", "4 @1  46546xW%0l 1 5")
+	r.Header.Set("Sec-WebSocket-Key2", "12998 5 Y3 1  .P00")
+	w := httptest.NewRecorder()
+
+	_, err := (&Upgrader{}).Upgrade(w, r)
+
+	if err != ErrUnsupportedDraftHandshake {
+		t.Fatalf("got error %v, want %v", err, ErrUnsupportedDraftHandshake)
+	}
+
+	if w.Code != http.StatusUpgradeRequired {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusUpgradeRequired)
+	}
+
+	if version := w.Header().Get("Sec-WebSocket-Version"); version != "13" {
+		t.Fatalf("got Sec-WebSocket-Version %q, want 13", version)
+	}
+}
+
+func TestUpgradeRequireSubprotocol(t *testing.T) {
+	selected := make(chan string, 1)
+
+	url := newTestServer(t, &Upgrader{Subprotocols: []string{"chat"}, RequireSubprotocol: true}, func(conn Conn) {
+		selected <- conn.Subprotocol()
+	})
+
+	for _, offered := range []string{"", "superchat"} {
+		header := http.Header{}
+
+		if offered != "" {
+			header.Set("Sec-WebSocket-Protocol", offered)
+		}
+
+		if resp := doHandshake(t, url, header); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("offered %q: got status %s, want 400", offered, resp.Status)
+		}
+	}
+
+	resp := doHandshake(t, url, http.Header{"Sec-WebSocket-Protocol": {"superchat, chat"}})
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %s, want 101", resp.Status)
+	}
+
+	if got := <-selected; got != "chat" {
+		t.Fatalf("got subprotocol %q, want chat", got)
+	}
+}
+
+func TestUpgradeWithoutHijacker(t *testing.T) {
+	w := httptest.NewRecorder()
+
+	conn, err := (&Upgrader{}).Upgrade(w, newHandshakeRequest())
+
+	if conn != nil || err != ErrHijackNotSupported {
+		t.Fatalf("got %v, %v, want %v", conn, err, ErrHijackNotSupported)
+	}
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestReadAfterTimeout(t *testing.T) {
+	timedOut := make(chan struct{})
+
+	url := newTestServer(t, &Upgrader{}, func(conn Conn) {
+		<-timedOut
+		conn.WriteMessage(TextMessage, []byte("late"))
+		conn.ReadMessage()
+	})
+
+	conn, err := Dial(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+
+	if _, _, err := conn.ReadMessage(); !isTimeout(err) {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+
+	close(timedOut)
+	conn.SetReadDeadline(time.Time{})
+
+	_, data, err := conn.ReadMessage()
+
+	if err != nil {
+		t.Fatalf("read after a timeout failed: %v", err)
+	}
+
+	if string(data) != "late" {
+		t.Fatalf("got %q, want %q", data, "late")
+	}
+}
+
+func TestWriteCoalesceWindow(t *testing.T) {
+	const (
+		window   = 50 * time.Millisecond
+		messages = 10
+	)
+
+	written := make(chanWriter, messages)
+	c := newTestConn(bytes.NewReader(nil), written)
+	c.coalesceWindow = window
+
+	data := []byte("tick")
+	start := time.Now()
+
+	for range messages {
+		if err := c.WriteMessage(TextMessage, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case p := <-written:
+		if elapsed := time.Since(start); elapsed > window+time.Second {
+			t.Fatalf("frames flushed after %v with a %v window", elapsed, window)
+		}
+
+		if want := messages * (2 + len(data)); len(p) != want {
+			t.Fatalf("first flush sent %d bytes, want all %d", len(p), want)
+		}
+	case <-time.After(window + time.Second):
+		t.Fatalf("frames not flushed within the %v window", window)
+	}
+}
+
+func BenchmarkWriteCoalesced(b *testing.B) {
+	data := []byte("a small message")
+
+	for _, window := range []time.Duration{0, time.Millisecond} {
+		b.Run(fmt.Sprint(window), func(b *testing.B) {
+			var writes atomic.Int64
+
+			c := newTestConn(bytes.NewReader(nil), countingWriter{&writes})
+			c.coalesceWindow = window
+
+			b.ReportAllocs()
+
+			for range b.N {
+				if err := c.WriteMessage(TextMessage, data); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			c.Close()
+			b.ReportMetric(float64(writes.Load())/float64(b.N), "writes/op")
+		})
+	}
+}
+
+// countingWriter discards its input and counts the calls to Write.
+type countingWriter struct {
+	writes *atomic.Int64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	w.writes.Add(1)
+
+	return len(p), nil
+}
+
+func TestAllowedMessageTypes(t *testing.T) {
+	in := append(
+		wstest.BuildFrame(true, opCodeBinary, true, testMask, []byte("bin")),
+		wstest.BuildFrame(true, opCodeText, true, testMask, []byte("text"))...,
+	)
+
+	out := new(bytes.Buffer)
+	c := newTestConn(bytes.NewReader(in), out)
+	c.SetAllowedMessageTypes(BinaryMessage)
+
+	if messageType, data, err := c.ReadMessage(); err != nil || messageType != BinaryMessage || string(data) != "bin" {
+		t.Fatalf("got %d, %q, %v, want the binary message", messageType, data, err)
+	}
+
+	if _, _, err := c.ReadMessage(); err != ErrMessageTypeNotAllowed {
+		t.Fatalf("got %v, want ErrMessageTypeNotAllowed", err)
+	}
+
+	if want := closeFrame(CloseUnsupportedData, ""); !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("wrote %x, want %x", out.Bytes(), want)
+	}
+
+	// Without arguments both types are accepted again.
+	c = newTestConn(bytes.NewReader(in), io.Discard)
+	c.SetAllowedMessageTypes(BinaryMessage)
+	c.SetAllowedMessageTypes()
+
+	for range 2 {
+		if _, _, err := c.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUnsolicitedPong(t *testing.T) {
+	out := new(bytes.Buffer)
+	c := newTestConn(bytes.NewReader(nil), out)
+
+	if err := c.Pong([]byte("beat")); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []byte{0x8A, 0x04, 'b', 'e', 'a', 't'}; !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("wrote %x, want %x", out.Bytes(), want)
+	}
+
+	// The peer hands it to its pong handler without answering.
+	in := append(bytes.Clone(out.Bytes()), 0x81, 0x00)
+	answers := new(bytes.Buffer)
+	r := newTestConn(bytes.NewReader(in), answers)
+	r.isClient = true
+
+	var got []byte
+	r.SetPongHandler(func(data []byte) { got = bytes.Clone(data) })
+
+	if _, _, err := r.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != "beat" || answers.Len() != 0 {
+		t.Fatalf("pong handler got %q and the peer wrote %x", got, answers.Bytes())
+	}
+
+	out.Reset()
+
+	if err := c.Pong(make([]byte, maxControlPayloadLength+1)); err != ErrControlFrameTooLarge || out.Len() != 0 {
+		t.Fatalf("got %v and wrote %d bytes for an oversized pong", err, out.Len())
+	}
+}
+
+func TestUpgradeBadMethod(t *testing.T) {
+	r := newHandshakeRequest()
+	r.Method = http.MethodPost
+	w := httptest.NewRecorder()
+
+	if _, err := (&Upgrader{}).Upgrade(w, r); err != ErrBadMethod {
+		t.Fatalf("got error %v, want %v", err, ErrBadMethod)
+	}
+
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+
+	if allow := w.Header().Get("Allow"); allow != http.MethodGet {
+		t.Fatalf("got Allow %q, want %q", allow, http.MethodGet)
+	}
+}
+
+func TestAllowUnmaskedClientFrames(t *testing.T) {
+	tests := []struct {
+		name string
+		u    *Upgrader
+		want []byte
+	}{
+		{"default", &Upgrader{}, closeFrame(CloseProtocolError, "")},
+		{"allowed", &Upgrader{AllowUnmaskedClientFrames: true}, []byte{0x81, 0x02, 'h', 'i'}},
+		{"strict", &Upgrader{AllowUnmaskedClientFrames: true, StrictMode: true}, closeFrame(CloseProtocolError, "")},
+	}
+
+	for _, tt := range tests {
+		url := newTestServer(t, tt.u, echo)
+
+		conn, err := net.Dial("tcp", strings.TrimPrefix(url, "ws://"))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer conn.Close()
+
+		r := newHandshakeRequest()
+
+		if err := r.Write(conn); err != nil {
+			t.Fatal(err)
+		}
+
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, r)
+
+		if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("%s: handshake failed: %v", tt.name, err)
+		}
+
+		conn.Write(wstest.BuildFrame(true, opCodeText, false, [4]byte{}, []byte("hi")))
+
+		got := make([]byte, len(tt.want))
+
+		if _, err := io.ReadFull(br, got); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		if !bytes.Equal(got, tt.want) {
+			t.Fatalf("%s: got %x, want %x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReadBufferedDataBeforeControlFrames(t *testing.T) {
+	in := append(
+		wstest.BuildFrame(true, opCodeText, true, testMask, []byte("hello world")),
+		wstest.BuildFrame(true, opCodePing, true, testMask, []byte("p"))...,
+	)
+	in = append(in, wstest.BuildFrame(true, opCodeClose, true, testMask, []byte{0x03, 0xE8})...)
+
+	out := new(bytes.Buffer)
+	c := newTestConn(bytes.NewReader(in), out)
+
+	var got []byte
+	p := make([]byte, 5)
+
+	// The rest of the first frame is returned before the ping is answered.
+	for len(got) < len("hello world") {
+		n, err := c.Read(p)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if out.Len() != 0 {
+			t.Fatalf("wrote %x while data of an earlier frame was buffered", out.Bytes())
+		}
+
+		got = append(got, p[:n]...)
+	}
+
+	if string(got) != "hello world" {
+		t.Fatalf("got %q, want %q", got, "hello world")
+	}
+
+	if _, err := c.Read(p); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+
+	want := append([]byte{0x8A, 0x01, 'p'}, closeFrame(CloseNormalClosure, "")...)
+
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("wrote %x, want the pong then the close %x", out.Bytes(), want)
+	}
+}
+
+func TestServeCancel(t *testing.T) {
+	served := make(chan error, 1)
+
+	url := newTestServer(t, &Upgrader{}, func(conn Conn) {
+		ctx, cancel := context.WithCancel(context.Background())
+		conn.SetMessageHandler(func(int, []byte) { cancel() })
+		served <- conn.Serve(ctx)
+	})
+
+	conn, err := Dial(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.WriteMessage(TextMessage, []byte("stop"))
+
+	if _, _, err := conn.ReadMessage(); !isCloseError(err, CloseGoingAway, "") {
+		t.Fatalf("client got %v, want a close with CloseGoingAway", err)
+	}
+
+	if err := <-served; err != context.Canceled {
+		t.Fatalf("Serve returned %v, want context.Canceled", err)
+	}
+}
+
+func TestSubprotocolFromAuthorization(t *testing.T) {
+	// The subprotocol is chosen by the tier of the authenticated client
+	// among the ones it offers.
+	u := &Upgrader{SelectSubprotocol: func(r *http.Request, offered []string) string {
+		if r.Header.Get("Authorization") == "Bearer premium" {
+			return "chat.v2"
+		}
+
+		return "chat.v1"
+	}}
+
+	url := newTestServer(t, u, func(conn Conn) {})
+
+	tests := []struct {
+		authorization string
+		offered       string
+		want          string
+	}{
+		{"Bearer premium", "chat.v1, chat.v2", "chat.v2"},
+		{"Bearer basic", "chat.v1, chat.v2", "chat.v1"},
+		{"Bearer premium", "chat.v1", ""},
+	}
+
+	for _, tt := range tests {
+		resp := doHandshake(t, url, http.Header{
+			"Authorization":          {tt.authorization},
+			"Sec-WebSocket-Protocol": {tt.offered},
+		})
+
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("got status %s", resp.Status)
+		}
+
+		if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != tt.want {
+			t.Fatalf("%s offering %q: got subprotocol %q, want %q", tt.authorization, tt.offered, got, tt.want)
+		}
+	}
+}
+
+func TestFrameReadTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+
+	frame := wstest.BuildFrame(true, opCodeBinary, false, [4]byte{}, bytes.Repeat([]byte{'x'}, 100))
+	release := make(chan struct{})
+
+	url := newTestServer(t, &Upgrader{}, func(conn Conn) {
+		// Stay idle past the timeout, then send a frame taking several times
+		// as long to arrive.
+		<-release
+
+		for i := 0; i < len(frame); i += 10 {
+			conn.UnderlyingConn().Write(frame[i:min(i+10, len(frame))])
+			time.Sleep(timeout / 4)
+		}
+
+		conn.ReadMessage()
+	})
+
+	conn, err := Dial(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.SetFrameReadTimeout(timeout)
+
+	if _, _, err := conn.ReadMessage(); !isTimeout(err) {
+		t.Fatalf("got %v from an idle peer, want a timeout", err)
+	}
+
+	close(release)
+	start := time.Now()
+
+	_, data, err := conn.ReadMessage()
+
+	if err != nil {
+		t.Fatalf("got %v from a peer trickling a frame", err)
+	}
+
+	if len(data) != 100 || time.Since(start) < 2*timeout {
+		t.Fatalf("read %d bytes in %v", len(data), time.Since(start))
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	// The example of section 1.3 of RFC 6455.
+	if accept := hashKey("dGhlIHNhbXBsZSBub25jZQ=="); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("got %s, want s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", accept)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() { hashKey("dGhlIHNhbXBsZSBub25jZQ==") })
+
+	if allocs > 1 {
+		t.Fatalf("hashKey allocates %v times, want at most the result", allocs)
+	}
+}
+
+func BenchmarkHashKey(b *testing.B) {
+	b.ReportAllocs()
+
+	for range b.N {
+		hashKey("dGhlIHNhbXBsZSBub25jZQ==")
+	}
+}
+
+func TestUpgradePipelinedFrame(t *testing.T) {
+	url := newTestServer(t, &Upgrader{}, echo)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "ws://"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	// The first frame is sent in the same write as the handshake request,
+	// so the server reads both at once.
+	r := newHandshakeRequest()
+	var request bytes.Buffer
+
+	if err := r.Write(&request); err != nil {
+		t.Fatal(err)
+	}
+
+	request.Write(wstest.BuildFrame(true, opCodeText, true, testMask, []byte("auth")))
+
+	if _, err := conn.Write(request.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, r)
+
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
+	got := make([]byte, 6)
+
+	if _, err := io.ReadFull(br, got); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []byte{0x81, 0x04, 'a', 'u', 't', 'h'}; !bytes.Equal(got, want) {
+		t.Fatalf("server echoed %x, want %x", got, want)
+	}
+}
+
+func TestMaxConnectionLifetime(t *testing.T) {
+	waited := make(chan error, 1)
+
+	url := newTestServer(t, &Upgrader{MaxConnectionLifetime: 50 * time.Millisecond}, func(conn Conn) {
+		waited <- conn.Wait()
+	})
+
+	conn, err := Dial(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	start := time.Now()
+
+	if _, _, err := conn.ReadMessage(); !isCloseError(err, CloseGoingAway, "") {
+		t.Fatalf("got %v, want a close with CloseGoingAway", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("closed after %v, before the lifetime elapsed", elapsed)
+	}
+
+	if err := <-waited; err != ErrLifetimeExceeded {
+		t.Fatalf("Wait returned %v, want ErrLifetimeExceeded", err)
+	}
+}
+
+// repeatReader returns data over and over.
+type repeatReader struct {
+	data []byte
+	off  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.off:])
+	r.off = (r.off + n) % len(r.data)
+
+	return n, nil
+}
+
+func BenchmarkReadJSON(b *testing.B) {
+	type event struct {
+		ID      int      `json:"id"`
+		Name    string   `json:"name"`
+		Tags    []string `json:"tags"`
+		Payload string   `json:"payload"`
+	}
+
+	data, _ := json.Marshal(event{ID: 1, Name: "update", Tags: []string{"a", "b"}, Payload: strings.Repeat("x", 1024)})
+	frame := wstest.BuildFrame(true, opCodeText, true, testMask, data)
+
+	b.Run("ReadJSON", func(b *testing.B) {
+		c := newTestConn(&repeatReader{data: frame}, io.Discard)
+		b.ReportAllocs()
+
+		for range b.N {
+			var v event
+
+			if err := c.ReadJSON(&v); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	// Reading the message first allocates it on top of the decoding.
+	b.Run("ReadMessage", func(b *testing.B) {
+		c := newTestConn(&repeatReader{data: frame}, io.Discard)
+		b.ReportAllocs()
+
+		for range b.N {
+			var v event
+
+			_, data, err := c.ReadMessage()
+
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			if err := json.Unmarshal(data, &v); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestOnHandshakeRequestSession(t *testing.T) {
+	errNoSession := errors.New("no session")
+	sessions := make(chan any, 1)
+
+	u := &Upgrader{OnHandshakeRequest: func(r *http.Request) (any, error) {
+		cookie, err := r.Cookie("session")
+
+		if err != nil {
+			return nil, errNoSession
+		}
+
+		return cookie.Value, nil
+	}}
+
+	url := newTestServer(t, u, func(conn Conn) {
+		sessions <- conn.UserData()
+	})
+
+	resp := doHandshake(t, url, http.Header{"Cookie": {"theme=dark; session=abc123"}})
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %s with a session cookie", resp.Status)
+	}
+
+	if session := <-sessions; session != "abc123" {
+		t.Fatalf("conn bound to session %v, want abc123", session)
+	}
+
+	resp = doHandshake(t, url, http.Header{"Cookie": {"theme=dark"}})
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("got status %s without a session cookie, want 403", resp.Status)
+	}
+
+	if body, _ := io.ReadAll(resp.Body); !strings.Contains(string(body), errNoSession.Error()) {
+		t.Fatalf("got body %q, want the rejection reason", body)
+	}
+}
+
+func TestRawFrameProxy(t *testing.T) {
+	frames := []Frame{
+		{Fin: false, OpCode: opCodeText, Payload: []byte("hel")},
+		{Fin: true, OpCode: opCodePing, Payload: []byte("p")},
+		{Fin: true, OpCode: opCodeContinuation, Payload: []byte("lo")},
+		{Fin: true, RSV: rsv1Bit, OpCode: opCodeBinary, Payload: []byte{0x01}},
+		{Fin: true, OpCode: opCodeClose, Payload: []byte{0x03, 0xE8}},
+	}
+
+	var in, want []byte
+
+	for _, f := range frames {
+		frame := wstest.BuildFrame(f.Fin, byte(f.OpCode), true, testMask, f.Payload)
+		frame[0] |= f.RSV
+		in = append(in, frame...)
+
+		frame = wstest.BuildFrame(f.Fin, byte(f.OpCode), false, [4]byte{}, f.Payload)
+		frame[0] |= f.RSV
+		want = append(want, frame...)
+	}
+
+	srcOut, dstOut := new(bytes.Buffer), new(bytes.Buffer)
+	src := newTestConn(bytes.NewReader(in), srcOut)
+	src.compress = true
+	dst := newTestConn(bytes.NewReader(nil), dstOut)
+
+	for range frames {
+		f, err := src.ReadRawFrame()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := dst.WriteRawFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !bytes.Equal(dstOut.Bytes(), want) {
+		t.Fatalf("proxied %x, want %x", dstOut.Bytes(), want)
+	}
+
+	// Neither the ping nor the Close were answered by the source.
+	if srcOut.Len() != 0 {
+		t.Fatalf("source wrote %x", srcOut.Bytes())
+	}
+
+	for _, f := range []Frame{{OpCode: 0x10}, {OpCode: opCodeText, RSV: 0x80}} {
+		if err := dst.WriteRawFrame(f); err != ErrInvalidFrame {
+			t.Fatalf("WriteRawFrame(%+v) returned %v, want ErrInvalidFrame", f, err)
+		}
+	}
+}
+
+func TestMaxFragments(t *testing.T) {
+	// fragmented returns a masked message split into n one-byte frames.
+	fragmented := func(n int) []byte {
+		in := wstest.BuildFrame(false, opCodeBinary, true, testMask, []byte{'x'})
+
+		for i := 1; i < n; i++ {
+			in = append(in, wstest.BuildFrame(i == n-1, opCodeContinuation, true, testMask, []byte{'x'})...)
+		}
+
+		return in
+	}
+
+	out := new(bytes.Buffer)
+	c := newTestConn(bytes.NewReader(append(fragmented(4), fragmented(5)...)), out)
+	c.SetMaxFragments(4)
+
+	if _, data, err := c.ReadMessage(); err != nil || len(data) != 4 {
+		t.Fatalf("got %d bytes and %v, want the message of 4 fragments", len(data), err)
+	}
+
+	if _, _, err := c.ReadMessage(); err != ErrTooManyFragments {
+		t.Fatalf("got %v, want ErrTooManyFragments", err)
+	}
+
+	if want := closeFrame(CloseMessageTooBig, ""); !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("wrote %x, want %x", out.Bytes(), want)
+	}
+
+	// Zero lifts the limit.
+	c = newTestConn(bytes.NewReader(fragmented(defaultMaxFragments+1)), io.Discard)
+	c.SetMaxFragments(0)
+
+	if _, data, err := c.ReadMessage(); err != nil || len(data) != defaultMaxFragments+1 {
+		t.Fatalf("got %d bytes and %v without a limit", len(data), err)
+	}
+}
+
+func TestClientControlFrameMasking(t *testing.T) {
+	in := wstest.BuildFrame(true, opCodePong, true, testMask, []byte("p"))
+	out := new(bytes.Buffer)
+	c := newTestConn(bytes.NewReader(in), out)
+	c.isClient = true
+
+	if err := c.PingWithData([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+
+	ping := out.Bytes()
+
+	if len(ping) != 8 || ping[0] != 0x89 || ping[1] != 0x80|2 {
+		t.Fatalf("client sent ping %x, want a masked frame", ping)
+	}
+
+	if payload := []byte{ping[6] ^ ping[2], ping[7] ^ ping[3]}; string(payload) != "hi" {
+		t.Fatalf("ping unmasks to %q", payload)
+	}
+
+	out.Reset()
+
+	// A server may not mask its frames, not even control frames.
+	if _, _, err := c.ReadMessage(); err != ErrMaskedFrame {
+		t.Fatalf("got %v, want ErrMaskedFrame", err)
+	}
+
+	closing := out.Bytes()
+
+	if len(closing) != 8 || closing[0] != 0x88 || closing[1] != 0x80|2 {
+		t.Fatalf("client sent close %x, want a masked frame", closing)
+	}
+
+	if code := int(closing[6]^closing[2])<<8 | int(closing[7]^closing[3]); code != CloseProtocolError {
+		t.Fatalf("client closed with code %d, want %d", code, CloseProtocolError)
+	}
+}
+
+func TestIsAliveAfterPeerClose(t *testing.T) {
+	url := newTestServer(t, &Upgrader{}, func(conn Conn) {
+		conn.CloseWithCode(CloseGoingAway, "")
+	})
+
+	conn, err := Dial(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	if !conn.IsAlive() {
+		t.Fatal("IsAlive is false right after dialing")
+	}
+
+	if _, _, err := conn.ReadMessage(); !isCloseError(err, CloseGoingAway, "") {
+		t.Fatalf("got %v, want the peer's close", err)
+	}
+
+	if conn.IsAlive() {
+		t.Fatal("IsAlive is true after the peer closed the connection")
+	}
+}
+
+func TestSetWriteBufferSize(t *testing.T) {
+	const (
+		frames    = 100
+		frameSize = 2 + 100
+	)
+
+	data := make([]byte, frameSize-2)
+
+	// writeBatch writes the frames held back by a coalescing window that
+	// never ends, so only a full buffer or a control frame flushes them,
+	// and returns the size of every write to the network.
+	writeBatch := func(bufferSize int) []int {
+		written := make(chanWriter, frames+1)
+		c := newTestConn(bytes.NewReader(nil), written)
+		c.coalesceWindow = time.Hour
+
+		if err := c.SetWriteBufferSize(bufferSize); err != nil {
+			t.Fatal(err)
+		}
+
+		for range frames {
+			if err := c.WriteMessage(BinaryMessage, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		c.Ping()
+		close(written)
+
+		var sizes []int
+
+		for p := range written {
+			sizes = append(sizes, len(p))
+		}
+
+		return sizes
+	}
+
+	// The default buffer is flushed every time it fills up.
+	if sizes := writeBatch(0); len(sizes) != frames*frameSize/defaultWriteBufferSize+1 || sizes[0] != defaultWriteBufferSize {
+		t.Fatalf("default buffer: wrote %v", sizes)
+	}
+
+	// A larger one holds the whole batch until the ping flushes it.
+	if sizes := writeBatch(16 << 10); len(sizes) != 1 || sizes[0] != frames*frameSize+2 {
+		t.Fatalf("16 KiB buffer: wrote %v, want a single write", sizes)
+	}
+}
+
+func TestUnread(t *testing.T) {
+	in := append(
+		wstest.BuildFrame(true, opCodeBinary, true, testMask, []byte("first")),
+		wstest.BuildFrame(true, opCodeText, true, testMask, []byte("second"))...,
+	)
+	c := newTestConn(bytes.NewReader(in), io.Discard)
+
+	messageType, data, err := c.ReadMessage()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Unread(messageType, data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only one message can be pushed back at a time.
+	if err := c.Unread(TextMessage, []byte("more")); err != ErrReadInProgress {
+		t.Fatalf("second Unread returned %v, want ErrReadInProgress", err)
+	}
+
+	for _, want := range []string{"first", "second"} {
+		_, data, err := c.ReadMessage()
+
+		if err != nil || string(data) != want {
+			t.Fatalf("got %q and %v, want %q", data, err, want)
+		}
+	}
+
+	// A message read partially through Read cannot be pushed back onto.
+	c = newTestConn(bytes.NewReader(in), io.Discard)
+
+	if _, err := c.Read(make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Unread(BinaryMessage, []byte("x")); err != ErrReadInProgress {
+		t.Fatalf("Unread in the middle of a message returned %v, want ErrReadInProgress", err)
+	}
+}
+
+func TestContextDoneAfterClose(t *testing.T) {
+	in := wstest.BuildFrame(true, opCodeClose, true, testMask, []byte{0x0F, 0xA0})
+	c := newTestConn(bytes.NewReader(in), io.Discard)
+	ctx := c.Context()
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("context done before the connection was closed")
+	default:
+	}
+
+	c.ReadMessage()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context not done after the peer closed the connection")
+	}
+
+	if cause := context.Cause(ctx); !isCloseError(cause, 4000, "") {
+		t.Fatalf("got cause %v, want the peer's close", cause)
+	}
+
+	// Without an error to report, the cause is context.Canceled, even for
+	// a context requested after the close.
+	c = newTestConn(bytes.NewReader(nil), io.Discard)
+	c.Close()
+
+	ctx = c.Context()
+	<-ctx.Done()
+
+	if cause := context.Cause(ctx); cause != context.Canceled {
+		t.Fatalf("got cause %v after Close, want context.Canceled", cause)
+	}
+}
@@ -0,0 +1,38 @@
+package ws
+
+// PacketConn exchanges packets over a websocket connection, each packet
+// being sent as one message. Unlike reading a Conn as a stream, the packet
+// boundaries are preserved, making it suitable to tunnel datagram
+// protocols.
+type PacketConn struct {
+	conn        Conn
+	messageType int
+}
+
+// NewPacketConn returns a PacketConn sending packets over conn as messages
+// of the given type, either TextMessage or BinaryMessage.
+func NewPacketConn(conn Conn, messageType int) *PacketConn {
+	return &PacketConn{conn: conn, messageType: messageType}
+}
+
+// ReadPacket returns the next packet, whatever the type of the message
+// carrying it.
+func (pc *PacketConn) ReadPacket() ([]byte, error) {
+	_, data, err := pc.conn.ReadMessage()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// WritePacket sends p as a single packet.
+func (pc *PacketConn) WritePacket(p []byte) error {
+	return pc.conn.WriteMessage(pc.messageType, p)
+}
+
+// Close closes the underlying connection.
+func (pc *PacketConn) Close() error {
+	return pc.conn.Close()
+}
@@ -0,0 +1,41 @@
+package ws
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPacketConnBoundaries(t *testing.T) {
+	packets := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{0xFF}, 3000)}
+
+	url := newTestServer(t, &Upgrader{}, func(conn Conn) {
+		pc := NewPacketConn(conn, BinaryMessage)
+
+		for _, p := range packets {
+			pc.WritePacket(p)
+		}
+
+		conn.ReadMessage()
+	})
+
+	conn, err := Dial(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pc := NewPacketConn(conn, BinaryMessage)
+	defer pc.Close()
+
+	for i, want := range packets {
+		got, err := pc.ReadPacket()
+
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+
+		if !bytes.Equal(got, want) {
+			t.Fatalf("packet %d: got %d bytes, want %d", i, len(got), len(want))
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package ws
+
+import (
+	"errors"
+	"net"
+)
+
+// QueuePolicy decides what Enqueue does when the write queue of a
+// connection is full.
+type QueuePolicy int
+
+const (
+	// QueueBlock makes Enqueue wait for room in the queue.
+	QueueBlock QueuePolicy = iota
+	// QueueDropOldest discards the oldest queued message to make room.
+	QueueDropOldest
+	// QueueDropNewest discards the message being enqueued.
+	QueueDropNewest
+)
+
+// ErrQueueFull is returned by Enqueue when a message is discarded under
+// the QueueDropNewest policy.
+var ErrQueueFull = errors.New("write queue is full, message was dropped")
+
+type queuedMessage struct {
+	messageType int
+	data        []byte
+}
+
+func (c *connImpl) Enqueue(messageType int, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return ErrInvalidMessageType
+	}
+
+	if c.queue == nil {
+		return c.WriteMessage(messageType, data)
+	}
+
+	msg := queuedMessage{messageType: messageType, data: data}
+
+	for {
+		select {
+		case <-c.done:
+			return net.ErrClosed
+		default:
+		}
+
+		select {
+		case c.queue <- msg:
+			return nil
+		default:
+		}
+
+		switch c.queuePolicy {
+		case QueueDropNewest:
+			return ErrQueueFull
+		case QueueDropOldest:
+			select {
+			case <-c.queue:
+			default:
+			}
+		default:
+			select {
+			case c.queue <- msg:
+				return nil
+			case <-c.done:
+				return net.ErrClosed
+			}
+		}
+	}
+}
+
+func (c *connImpl) Pending() int {
+	return len(c.queue)
+}
+
+// writeQueue writes queued messages until the connection is closed. A
+// failed write closes the connection, as the messages queued after it
+// cannot be delivered anymore.
+func (c *connImpl) writeQueue() {
+	for {
+		select {
+		case msg := <-c.queue:
+			if err := c.WriteMessage(msg.messageType, msg.data); err != nil {
+				c.logf("queued write failed: %v", err)
+				c.closeConn(err)
+
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package ws
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newQueuedTestConn returns a test connection with a write queue of the
+// given size and policy, which no goroutine drains.
+func newQueuedTestConn(size int, policy QueuePolicy) *connImpl {
+	c := newTestConn(bytes.NewReader(nil), io.Discard)
+	c.queue = make(chan queuedMessage, size)
+	c.queuePolicy = policy
+
+	return c
+}
+
+// queuedData returns the data of the messages in the queue of c.
+func queuedData(c *connImpl) []string {
+	var data []string
+
+	for len(c.queue) > 0 {
+		data = append(data, string((<-c.queue).data))
+	}
+
+	return data
+}
+
+func TestEnqueueDropNewest(t *testing.T) {
+	c := newQueuedTestConn(2, QueueDropNewest)
+
+	for _, data := range []string{"1", "2"} {
+		if err := c.Enqueue(TextMessage, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.Enqueue(TextMessage, []byte("3")); err != ErrQueueFull {
+		t.Fatalf("got %v with the queue full, want ErrQueueFull", err)
+	}
+
+	if got := queuedData(c); len(got) != 2 || got[0] != "1" || got[1] != "2" {
+		t.Fatalf("queue holds %q, want the first two messages", got)
+	}
+}
+
+func TestEnqueueDropOldest(t *testing.T) {
+	c := newQueuedTestConn(2, QueueDropOldest)
+
+	for _, data := range []string{"1", "2", "3"} {
+		if err := c.Enqueue(TextMessage, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := queuedData(c); len(got) != 2 || got[0] != "2" || got[1] != "3" {
+		t.Fatalf("queue holds %q, want the last two messages", got)
+	}
+}
+
+func TestEnqueueBlock(t *testing.T) {
+	c := newQueuedTestConn(2, QueueBlock)
+
+	for _, data := range []string{"1", "2"} {
+		if err := c.Enqueue(TextMessage, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	enqueued := make(chan error, 1)
+
+	go func() { enqueued <- c.Enqueue(TextMessage, []byte("3")) }()
+
+	select {
+	case err := <-enqueued:
+		t.Fatalf("Enqueue returned %v with the queue full", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Taking a message makes room for the blocked one.
+	<-c.queue
+
+	if err := <-enqueued; err != nil {
+		t.Fatal(err)
+	}
+
+	if got := queuedData(c); len(got) != 2 || got[0] != "2" || got[1] != "3" {
+		t.Fatalf("queue holds %q, want the last two messages", got)
+	}
+
+	// Closing the connection releases a blocked Enqueue.
+	c.Enqueue(TextMessage, []byte("4"))
+	c.Enqueue(TextMessage, []byte("5"))
+
+	go func() { enqueued <- c.Enqueue(TextMessage, []byte("6")) }()
+
+	c.closeConn(nil)
+
+	if err := <-enqueued; err != net.ErrClosed {
+		t.Fatalf("got %v once closed, want net.ErrClosed", err)
+	}
+}
+
+func TestPendingBehindPausedWriter(t *testing.T) {
+	// Writes block until the test receives them, pausing the writer.
+	written := make(chanWriter)
+	c := newTestConn(bytes.NewReader(nil), written)
+	c.queue = make(chan queuedMessage, 8)
+
+	go c.writeQueue()
+	defer c.closeConn(nil)
+
+	for _, data := range []string{"1", "2", "3", "4"} {
+		if err := c.Enqueue(TextMessage, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The writer takes the first message and blocks sending it.
+	deadline := time.Now().Add(time.Second)
+
+	for c.Pending() != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Pending is %d, want 3 messages behind the paused writer", c.Pending())
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, data := range []string{"1", "2", "3", "4"} {
+		if p := <-written; string(p[2:]) != data {
+			t.Fatalf("wrote %q, want %q", p[2:], data)
+		}
+	}
+
+	if n := c.Pending(); n != 0 {
+		t.Fatalf("Pending is %d once every message was written", n)
+	}
+}
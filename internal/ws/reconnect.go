@@ -0,0 +1,951 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+)
+
+// ErrReconnected is returned by Read on a connection opened with a
+// ReconnectingDialer when the connection dropped and was re-established.
+// Any message the application was in the middle of reading is lost, so it
+// marks a boundary after which reading starts over on a fresh stream.
+var ErrReconnected = errors.New("connection was re-established, partially read data was lost")
+
+// ReconnectingDialer opens client connections that transparently redial
+// with exponential backoff when a read or write fails.
+type ReconnectingDialer struct {
+	// Dialer is used to open every connection. Defaults to a zero Dialer.
+	Dialer *Dialer
+	// MinBackoff is the delay before the first redial attempt, doubling on
+	// every failed attempt up to MaxBackoff. Defaults to 100ms and 30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Jitter randomizes each delay by up to the given fraction of it,
+	// e.g. 0.2 makes delays vary by +/-20%.
+	Jitter float64
+	// MaxAttempts is the number of consecutive failed redials after which
+	// the connection gives up. Zero means retrying forever.
+	MaxAttempts int
+	// OnReconnect is called with every re-established connection before it
+	// is used, e.g. to re-authenticate or re-subscribe. Returning an error
+	// counts as a failed attempt.
+	OnReconnect func(conn Conn) error
+}
+
+type reconnectingConn struct {
+	d      *ReconnectingDialer
+	ctx    context.Context
+	urlStr string
+
+	mu     sync.Mutex
+	conn   Conn
+	gen    int
+	closed bool
+	// reconnecting is the reconnection in progress, if any, which other
+	// goroutines failing on the same connection wait for.
+	reconnecting *reconnection
+	// options replays the settings applied to the connection on every
+	// re-established one, in the order they were last set.
+	options      []option
+	validateUTF8 bool
+	// truncateCloseReason mirrors SetTruncateCloseReason so the reason can
+	// be checked before the connection is marked closed.
+	truncateCloseReason bool
+	// messages is the channel returned by Messages, messagesErr holds the
+	// error that closed it.
+	messagesOnce sync.Once
+	messages     chan InboundMessage
+	messagesErr  error
+	// messageHandler is the handler Serve dispatches messages to.
+	messageHandler func(messageType int, data []byte)
+	// userData is kept here rather than on the underlying connection so it
+	// survives reconnections.
+	userData any
+	// name mirrors SetName, which is also replayed on every connection.
+	name string
+	// done is closed by Close to interrupt a reconnection in progress.
+	done      chan struct{}
+	closeOnce sync.Once
+	// closeCtx is the context returned by Context, which unlike the one of
+	// the underlying connection outlives reconnections.
+	closeCtxOnce sync.Once
+	closeCtx     context.Context
+}
+
+// DialContext opens a client connection to urlStr which is re-established
+// whenever it drops. The context bounds the initial dial and every redial,
+// cancelling it stops further reconnection attempts.
+func (d *ReconnectingDialer) DialContext(ctx context.Context, urlStr string) (Conn, error) {
+	conn, err := d.dialer().DialContext(ctx, urlStr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &reconnectingConn{
+		d:      d,
+		ctx:    ctx,
+		urlStr: urlStr,
+		conn:   conn,
+		done:   make(chan struct{}),
+	}, nil
+}
+
+func (d *ReconnectingDialer) dialer() *Dialer {
+	if d.Dialer == nil {
+		return defaultDialer
+	}
+
+	return d.Dialer
+}
+
+// backoff returns the delay to wait before the given redial attempt.
+func (d *ReconnectingDialer) backoff(attempt int) time.Duration {
+	minBackoff := d.MinBackoff
+
+	if minBackoff <= 0 {
+		minBackoff = defaultMinBackoff
+	}
+
+	maxBackoff := d.MaxBackoff
+
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+
+	delay := minBackoff
+
+	for i := 0; i < attempt && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+
+	delay = min(delay, maxBackoff)
+
+	if d.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * d.Jitter * float64(delay))
+	}
+
+	return delay
+}
+
+// current returns the connection in use and its generation, which is
+// incremented every time the connection is re-established.
+func (c *reconnectingConn) current() (Conn, int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, 0, net.ErrClosed
+	}
+
+	return c.conn, c.gen, nil
+}
+
+// option is a setting replayed on re-established connections. Setting the
+// same option again replaces it, so only the last value is replayed.
+type option struct {
+	name  string
+	apply func(conn Conn) error
+}
+
+// isTimeout reports whether err is a timeout, such as a read deadline
+// expiring, which leaves the connection usable.
+func isTimeout(err error) bool {
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// reconnection is a reconnection in progress, err holds its outcome once
+// done is closed.
+type reconnection struct {
+	done chan struct{}
+	err  error
+}
+
+// reconnect replaces the connection of the given generation. If another
+// goroutine already replaced it, reconnect returns immediately, and if it
+// is replacing it, reconnect waits for it to finish. c.mu is not held
+// while redialing, so the other methods keep working on the dropped
+// connection in the meantime.
+func (c *reconnectingConn) reconnect(gen int) error {
+	c.mu.Lock()
+
+	if c.closed {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+
+	if c.gen != gen {
+		c.mu.Unlock()
+		return nil
+	}
+
+	if r := c.reconnecting; r != nil {
+		c.mu.Unlock()
+		<-r.done
+
+		return r.err
+	}
+
+	r := &reconnection{done: make(chan struct{})}
+	c.reconnecting = r
+	dropped := c.conn
+	c.mu.Unlock()
+
+	dropped.Close()
+	conn, err := c.redial()
+
+	c.mu.Lock()
+
+	if err == nil && c.closed {
+		conn.Close()
+		err = net.ErrClosed
+	}
+
+	if err == nil {
+		// Options set while redialing were only applied to the dropped
+		// connection, so all of them are replayed while c.mu is held.
+		for _, option := range c.options {
+			option.apply(conn)
+		}
+
+		c.conn = conn
+		c.gen++
+	}
+
+	c.reconnecting = nil
+	r.err = err
+	c.mu.Unlock()
+	close(r.done)
+
+	return err
+}
+
+// redial opens a new connection, backing off between failed attempts.
+func (c *reconnectingConn) redial() (Conn, error) {
+	for attempt := 0; c.d.MaxAttempts == 0 || attempt < c.d.MaxAttempts; attempt++ {
+		timer := time.NewTimer(c.d.backoff(attempt))
+
+		select {
+		case <-c.ctx.Done():
+			timer.Stop()
+			return nil, c.ctx.Err()
+		case <-c.done:
+			timer.Stop()
+			return nil, net.ErrClosed
+		case <-timer.C:
+		}
+
+		conn, err := c.d.dialer().DialContext(c.ctx, c.urlStr)
+
+		if err != nil {
+			continue
+		}
+
+		select {
+		case <-c.done:
+			conn.Close()
+			return nil, net.ErrClosed
+		default:
+		}
+
+		if c.d.OnReconnect != nil {
+			if err := c.d.OnReconnect(conn); err != nil {
+				conn.Close()
+				continue
+			}
+		}
+
+		return conn, nil
+	}
+
+	return nil, errors.New("giving up reconnecting after too many failed attempts")
+}
+
+func (c *reconnectingConn) Read(p []byte) (int, error) {
+	conn, gen, err := c.current()
+
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := conn.Read(p)
+
+	if err == nil || isTimeout(err) {
+		return n, err
+	}
+
+	if err := c.reconnect(gen); err != nil {
+		return 0, err
+	}
+
+	return 0, ErrReconnected
+}
+
+func (c *reconnectingConn) ReadMessage() (int, []byte, error) {
+	conn, gen, err := c.current()
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	messageType, data, err := conn.ReadMessage()
+
+	if err == nil || isTimeout(err) {
+		return messageType, data, err
+	}
+
+	if err := c.reconnect(gen); err != nil {
+		return 0, nil, err
+	}
+
+	return 0, nil, ErrReconnected
+}
+
+func (c *reconnectingConn) ReadJSON(v any) error {
+	// Going through ReadMessage tells read failures that need a reconnection
+	// apart from messages that are not valid JSON.
+	_, data, err := c.ReadMessage()
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func (c *reconnectingConn) Unread(messageType int, data []byte) error {
+	conn, _, err := c.current()
+
+	if err != nil {
+		return err
+	}
+
+	return conn.Unread(messageType, data)
+}
+
+func (c *reconnectingConn) ReadMessageSpooled() (int, SpooledMessage, error) {
+	conn, gen, err := c.current()
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	messageType, message, err := conn.ReadMessageSpooled()
+
+	if err == nil || isTimeout(err) {
+		return messageType, message, err
+	}
+
+	if err := c.reconnect(gen); err != nil {
+		return 0, nil, err
+	}
+
+	return 0, nil, ErrReconnected
+}
+
+// Messages delivers messages across reconnections, ErrReconnected does not
+// close the channel.
+func (c *reconnectingConn) Messages() <-chan InboundMessage {
+	c.messagesOnce.Do(func() {
+		c.messages = make(chan InboundMessage)
+
+		go c.readMessages()
+	})
+
+	return c.messages
+}
+
+func (c *reconnectingConn) MessagesErr() error {
+	return c.messagesErr
+}
+
+func (c *reconnectingConn) readMessages() {
+	defer close(c.messages)
+
+	for {
+		messageType, data, err := c.ReadMessage()
+
+		if err == ErrReconnected {
+			continue
+		}
+
+		if err != nil {
+			c.messagesErr = err
+			return
+		}
+
+		select {
+		case c.messages <- InboundMessage{Type: messageType, Data: data}:
+		case <-c.done:
+			c.messagesErr = net.ErrClosed
+			return
+		}
+	}
+}
+
+func (c *reconnectingConn) SetMessageHandler(handler func(messageType int, data []byte)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.messageHandler = handler
+}
+
+// Serve keeps going across reconnections, it only returns once
+// reconnecting failed or the connection was closed.
+func (c *reconnectingConn) Serve(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() { c.CloseWithCode(CloseGoingAway, "") })
+	defer stop()
+
+	for {
+		messageType, data, err := c.ReadMessage()
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err == ErrReconnected {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		c.mu.Lock()
+		handler := c.messageHandler
+		c.mu.Unlock()
+
+		if handler != nil {
+			handler(messageType, data)
+		}
+	}
+}
+
+func (c *reconnectingConn) Write(p []byte) (int, error) {
+	conn, gen, err := c.current()
+
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := conn.Write(p)
+
+	if err == nil {
+		return n, nil
+	}
+
+	if err := c.reconnect(gen); err != nil {
+		return 0, err
+	}
+
+	conn, _, err = c.current()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return conn.Write(p)
+}
+
+func (c *reconnectingConn) WriteMessage(messageType int, data []byte) error {
+	conn, gen, err := c.current()
+
+	if err != nil {
+		return err
+	}
+
+	if err := conn.WriteMessage(messageType, data); err == nil || err == ErrInvalidMessageType {
+		return err
+	}
+
+	if err := c.reconnect(gen); err != nil {
+		return err
+	}
+
+	conn, _, err = c.current()
+
+	if err != nil {
+		return err
+	}
+
+	return conn.WriteMessage(messageType, data)
+}
+
+// Enqueue writes directly, dialed connections have no write queue.
+func (c *reconnectingConn) Enqueue(messageType int, data []byte) error {
+	return c.WriteMessage(messageType, data)
+}
+
+func (c *reconnectingConn) Pending() int {
+	return 0
+}
+
+func (c *reconnectingConn) WriteText(data []byte) error {
+	c.mu.Lock()
+	validateUTF8 := c.validateUTF8
+	c.mu.Unlock()
+
+	if validateUTF8 && !utf8.Valid(data) {
+		return ErrInvalidUTF8
+	}
+
+	return c.WriteMessage(TextMessage, data)
+}
+
+func (c *reconnectingConn) WriteBinary(data []byte) error {
+	return c.WriteMessage(BinaryMessage, data)
+}
+
+func (c *reconnectingConn) SetValidateUTF8(enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.validateUTF8 = enabled
+}
+
+func (c *reconnectingConn) WriteMessageWithDeadline(messageType int, data []byte, deadline time.Time) error {
+	conn, _, err := c.current()
+
+	if err != nil {
+		return err
+	}
+
+	return conn.WriteMessageWithDeadline(messageType, data, deadline)
+}
+
+func (c *reconnectingConn) NextWriter(messageType int) (io.WriteCloser, error) {
+	conn, _, err := c.current()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.NextWriter(messageType)
+}
+
+func (c *reconnectingConn) WriteFrom(messageType int, r io.Reader) error {
+	conn, _, err := c.current()
+
+	if err != nil {
+		return err
+	}
+
+	return conn.WriteFrom(messageType, r)
+}
+
+func (c *reconnectingConn) ForwardTo(dst Conn) error {
+	conn, _, err := c.current()
+
+	if err != nil {
+		return err
+	}
+
+	return conn.ForwardTo(dst)
+}
+
+func (c *reconnectingConn) ReadRawFrame() (Frame, error) {
+	conn, _, err := c.current()
+
+	if err != nil {
+		return Frame{}, err
+	}
+
+	return conn.ReadRawFrame()
+}
+
+func (c *reconnectingConn) WriteRawFrame(f Frame) error {
+	conn, _, err := c.current()
+
+	if err != nil {
+		return err
+	}
+
+	return conn.WriteRawFrame(f)
+}
+
+func (c *reconnectingConn) writeRawFrame(fin bool, rsv byte, opCode byte, payload []byte) error {
+	conn, _, err := c.current()
+
+	if err != nil {
+		return err
+	}
+
+	w, ok := conn.(rawFrameWriter)
+
+	if !ok {
+		return ErrForwardNotSupported
+	}
+
+	return w.writeRawFrame(fin, rsv, opCode, payload)
+}
+
+func (c *reconnectingConn) CompressionEnabled() bool {
+	conn, _, err := c.current()
+
+	if err != nil {
+		return false
+	}
+
+	return conn.CompressionEnabled()
+}
+
+func (c *reconnectingConn) LastMessageCompressed() bool {
+	conn, _, err := c.current()
+
+	if err != nil {
+		return false
+	}
+
+	return conn.LastMessageCompressed()
+}
+
+func (c *reconnectingConn) Ping() error {
+	return c.PingWithData(nil)
+}
+
+func (c *reconnectingConn) PingWithData(data []byte) error {
+	conn, _, err := c.current()
+
+	if err != nil {
+		return err
+	}
+
+	return conn.PingWithData(data)
+}
+
+func (c *reconnectingConn) Pong(data []byte) error {
+	conn, _, err := c.current()
+
+	if err != nil {
+		return err
+	}
+
+	return conn.Pong(data)
+}
+
+func (c *reconnectingConn) SetPongHandler(handler func(data []byte)) {
+	c.setOption("pongHandler", func(conn Conn) error {
+		conn.SetPongHandler(handler)
+
+		return nil
+	})
+}
+
+func (c *reconnectingConn) IsAlive() bool {
+	conn, _, err := c.current()
+
+	if err != nil {
+		return false
+	}
+
+	return conn.IsAlive()
+}
+
+// Wait only returns once Close is called, as dropped connections are
+// re-established.
+func (c *reconnectingConn) Wait() error {
+	<-c.done
+
+	return nil
+}
+
+func (c *reconnectingConn) Context() context.Context {
+	c.closeCtxOnce.Do(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		c.closeCtx = ctx
+
+		go func() {
+			<-c.done
+			cancel()
+		}()
+	})
+
+	return c.closeCtx
+}
+
+func (c *reconnectingConn) CloseWithCode(code int, reason string) error {
+	if !validCloseCode(code) {
+		return ErrInvalidCloseCode
+	}
+
+	c.mu.Lock()
+	truncate := c.truncateCloseReason
+	c.mu.Unlock()
+
+	if truncate {
+		reason = truncateUTF8(reason, maxCloseReasonLength)
+	}
+
+	if len(reason) > maxCloseReasonLength {
+		return ErrCloseReasonTooLong
+	}
+
+	err := net.ErrClosed
+
+	c.closeOnce.Do(func() {
+		close(c.done)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.closed = true
+		err = c.conn.CloseWithCode(code, reason)
+	})
+
+	return err
+}
+
+func (c *reconnectingConn) SetTruncateCloseReason(enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.truncateCloseReason = enabled
+}
+
+func (c *reconnectingConn) SetDefaultCloseCode(code int) error {
+	if code != 0 && !validCloseCode(code) {
+		return ErrInvalidCloseCode
+	}
+
+	return c.setOption("defaultCloseCode", func(conn Conn) error {
+		return conn.SetDefaultCloseCode(code)
+	})
+}
+
+func (c *reconnectingConn) CloseGracefully(ctx context.Context, code int, reason string) error {
+	if !validCloseCode(code) {
+		return ErrInvalidCloseCode
+	}
+
+	c.mu.Lock()
+	truncate := c.truncateCloseReason
+	c.mu.Unlock()
+
+	if truncate {
+		reason = truncateUTF8(reason, maxCloseReasonLength)
+	}
+
+	if len(reason) > maxCloseReasonLength {
+		return ErrCloseReasonTooLong
+	}
+
+	err := net.ErrClosed
+
+	c.closeOnce.Do(func() {
+		close(c.done)
+
+		c.mu.Lock()
+		c.closed = true
+		conn := c.conn
+		c.mu.Unlock()
+
+		err = conn.CloseGracefully(ctx, code, reason)
+	})
+
+	return err
+}
+
+func (c *reconnectingConn) Close() error {
+	err := net.ErrClosed
+
+	c.closeOnce.Do(func() {
+		close(c.done)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.closed = true
+		err = c.conn.Close()
+	})
+
+	return err
+}
+
+// SetReadDeadline is replayed on re-established connections, so a dropped
+// connection does not lift it.
+func (c *reconnectingConn) SetReadDeadline(t time.Time) error {
+	return c.setOption("readDeadline", func(conn Conn) error {
+		return conn.SetReadDeadline(t)
+	})
+}
+
+func (c *reconnectingConn) SetFrameReadTimeout(d time.Duration) {
+	c.setOption("frameReadTimeout", func(conn Conn) error {
+		conn.SetFrameReadTimeout(d)
+
+		return nil
+	})
+}
+
+func (c *reconnectingConn) SetWriteDeadline(t time.Time) error {
+	conn, _, err := c.current()
+
+	if err != nil {
+		return err
+	}
+
+	return conn.SetWriteDeadline(t)
+}
+
+func (c *reconnectingConn) SetCompressionThreshold(bytes int) {
+	c.setOption("compressionThreshold", func(conn Conn) error {
+		conn.SetCompressionThreshold(bytes)
+
+		return nil
+	})
+}
+
+func (c *reconnectingConn) SetReadBufferSize(bytes int) error {
+	return c.setOption("readBufferSize", func(conn Conn) error {
+		return conn.SetReadBufferSize(bytes)
+	})
+}
+
+func (c *reconnectingConn) SetWriteBufferSize(bytes int) error {
+	return c.setOption("writeBufferSize", func(conn Conn) error {
+		return conn.SetWriteBufferSize(bytes)
+	})
+}
+
+func (c *reconnectingConn) SetReadFrameLimit(bytes int64) {
+	c.setOption("readFrameLimit", func(conn Conn) error {
+		conn.SetReadFrameLimit(bytes)
+
+		return nil
+	})
+}
+
+func (c *reconnectingConn) SetReadLimit(bytes int64) {
+	c.setOption("readLimit", func(conn Conn) error {
+		conn.SetReadLimit(bytes)
+
+		return nil
+	})
+}
+
+func (c *reconnectingConn) SetMaxFragments(n int) {
+	c.setOption("maxFragments", func(conn Conn) error {
+		conn.SetMaxFragments(n)
+
+		return nil
+	})
+}
+
+func (c *reconnectingConn) SetAllowedMessageTypes(messageTypes ...int) {
+	c.setOption("allowedMessageTypes", func(conn Conn) error {
+		conn.SetAllowedMessageTypes(messageTypes...)
+
+		return nil
+	})
+}
+
+func (c *reconnectingConn) Subprotocol() string {
+	conn, _, err := c.current()
+
+	if err != nil {
+		return ""
+	}
+
+	return conn.Subprotocol()
+}
+
+func (c *reconnectingConn) Extensions() string {
+	conn, _, err := c.current()
+
+	if err != nil {
+		return ""
+	}
+
+	return conn.Extensions()
+}
+
+func (c *reconnectingConn) SetUserData(data any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.userData = data
+}
+
+func (c *reconnectingConn) UserData() any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.userData
+}
+
+func (c *reconnectingConn) SetName(name string) {
+	c.setOption("name", func(conn Conn) error {
+		conn.SetName(name)
+
+		return nil
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.name = name
+}
+
+func (c *reconnectingConn) Name() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.name
+}
+
+func (c *reconnectingConn) NegotiatedExtensions() []Extension {
+	conn, _, err := c.current()
+
+	if err != nil {
+		return nil
+	}
+
+	return conn.NegotiatedExtensions()
+}
+
+func (c *reconnectingConn) UnderlyingConn() net.Conn {
+	conn, _, err := c.current()
+
+	if err != nil {
+		return nil
+	}
+
+	return conn.UnderlyingConn()
+}
+
+// setOption applies the named option to the current connection and, if
+// that succeeds, records it so it is applied again to re-established
+// connections in place of any earlier value. An option that fails is
+// reported and not replayed, leaving the earlier value in effect.
+func (c *reconnectingConn) setOption(name string, apply func(conn Conn) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+
+	if err := apply(c.conn); err != nil {
+		return err
+	}
+
+	c.options = slices.DeleteFunc(c.options, func(o option) bool { return o.name == name })
+	c.options = append(c.options, option{name: name, apply: apply})
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReconnectAfterServerDrop(t *testing.T) {
+	var dials atomic.Int32
+
+	url := newTestServer(t, &Upgrader{}, func(conn Conn) {
+		// The first connection drops without a close handshake, the next
+		// ones echo messages.
+		if dials.Add(1) == 1 {
+			conn.WriteMessage(TextMessage, []byte("first"))
+			conn.UnderlyingConn().Close()
+
+			return
+		}
+
+		for {
+			messageType, data, err := conn.ReadMessage()
+
+			if err != nil {
+				return
+			}
+
+			conn.WriteMessage(messageType, data)
+		}
+	})
+
+	d := &ReconnectingDialer{MinBackoff: time.Millisecond}
+	conn, err := d.DialContext(context.Background(), url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "first" {
+		t.Fatalf("got %q %v, want the first message", data, err)
+	}
+
+	if _, _, err := conn.ReadMessage(); err != ErrReconnected {
+		t.Fatalf("got %v once the server dropped the connection, want ErrReconnected", err)
+	}
+
+	if err := conn.WriteMessage(TextMessage, []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "second" {
+		t.Fatalf("got %q %v, want the echoed message", data, err)
+	}
+
+	if n := dials.Load(); n != 2 {
+		t.Fatalf("server accepted %d connections, want 2", n)
+	}
+}
+
+func TestReconnectReadTimeout(t *testing.T) {
+	var dials atomic.Int32
+
+	url := newTestServer(t, &Upgrader{}, func(conn Conn) {
+		dials.Add(1)
+		conn.ReadMessage()
+	})
+
+	d := &ReconnectingDialer{MinBackoff: time.Millisecond}
+	conn, err := d.DialContext(context.Background(), url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	if err := conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = conn.ReadMessage()
+
+	if !isTimeout(err) {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+
+	if n := dials.Load(); n != 1 {
+		t.Fatalf("server accepted %d connections after a timeout, want 1", n)
+	}
+}
+
+func TestReconnectReplaysOptions(t *testing.T) {
+	url := newTestServer(t, &Upgrader{}, func(conn Conn) {
+		conn.UnderlyingConn().Close()
+	})
+
+	d := &ReconnectingDialer{MinBackoff: time.Millisecond}
+	conn, err := d.DialContext(context.Background(), url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	c := conn.(*reconnectingConn)
+	deadline := time.Now().Add(time.Hour)
+
+	c.SetReadLimit(1024)
+	c.SetReadLimit(2048)
+	c.SetReadDeadline(deadline)
+
+	if err := c.setOption("failing", func(Conn) error { return errors.New("failed") }); err == nil {
+		t.Fatal("a failing option reported no error")
+	}
+
+	if len(c.options) != 2 || c.options[0].name != "readLimit" || c.options[1].name != "readDeadline" {
+		t.Fatalf("recorded %d options, want the read limit and deadline once each", len(c.options))
+	}
+
+	_, gen, _ := c.current()
+
+	if err := c.reconnect(gen); err != nil {
+		t.Fatal(err)
+	}
+
+	next, _, _ := c.current()
+	impl := next.(*connImpl)
+
+	if impl.readLimit != 2048 {
+		t.Fatalf("read limit %d replayed, want the last value 2048", impl.readLimit)
+	}
+
+	if !impl.readDeadline.Equal(deadline) {
+		t.Fatalf("read deadline %v replayed, want %v", impl.readDeadline, deadline)
+	}
+}
@@ -0,0 +1,22 @@
+package ws
+
+// Recover wraps a function serving an upgraded connection so that a panic
+// in it closes the connection with CloseInternalServerErr instead of just
+// dropping it, letting the peer know the server failed. The panic is then
+// logged through the Logger hook of the connection, if any, and not
+// propagated further.
+func Recover(handler func(conn Conn)) func(conn Conn) {
+	return func(conn Conn) {
+		defer func() {
+			if v := recover(); v != nil {
+				if l, ok := conn.(interface{ logf(string, ...any) }); ok {
+					l.logf("recovered from panic in handler: %v", v)
+				}
+
+				conn.CloseWithCode(CloseInternalServerErr, "internal error")
+			}
+		}()
+
+		handler(conn)
+	}
+}
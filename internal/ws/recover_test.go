@@ -0,0 +1,37 @@
+package ws
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestRecover(t *testing.T) {
+	var logged []string
+
+	out := new(bytes.Buffer)
+	c := newTestConn(bytes.NewReader(nil), out)
+	c.hooks = &Hooks{Logger: func(format string, args ...any) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}}
+
+	Recover(func(conn Conn) { panic("boom") })(c)
+
+	if want := closeFrame(CloseInternalServerErr, "internal error"); !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("wrote %x, want %x", out.Bytes(), want)
+	}
+
+	if len(logged) != 1 || logged[0] != "recovered from panic in handler: boom" {
+		t.Fatalf("logged %q", logged)
+	}
+
+	// A handler returning normally leaves the connection open.
+	out.Reset()
+	c = newTestConn(bytes.NewReader(nil), out)
+
+	Recover(func(conn Conn) {})(c)
+
+	if out.Len() != 0 || !c.IsAlive() {
+		t.Fatalf("wrote %x after a handler that did not panic", out.Bytes())
+	}
+}
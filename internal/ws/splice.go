@@ -0,0 +1,65 @@
+package ws
+
+import "errors"
+
+// Splice copies messages between a and b in both directions until either
+// connection closes or fails, e.g. to proxy a client to an upstream server.
+// Messages are read whole and written again by the other connection, so
+// each side frames, masks and compresses them according to its own role
+// and negotiated extensions, and pings are answered by the side receiving
+// them. When one peer closes its connection, the same status code and
+// reason are sent to the other one; any other failure closes the other
+// connection with CloseGoingAway. Both connections are closed when Splice
+// returns the error that ended it, or nil if a peer closed its connection
+// with CloseNormalClosure or without a status code. No other method
+// reading from a or b may be used while Splice is running.
+func Splice(a, b Conn) error {
+	errc := make(chan error, 2)
+
+	go func() { errc <- spliceMessages(a, b) }()
+	go func() { errc <- spliceMessages(b, a) }()
+
+	// The first copy to stop closes both connections, which ends the other.
+	err := <-errc
+	<-errc
+
+	var closeErr *CloseError
+
+	if errors.As(err, &closeErr) && (closeErr.Code == CloseNormalClosure || closeErr.Code == CloseNoStatusReceived) {
+		return nil
+	}
+
+	return err
+}
+
+// spliceMessages copies messages from src to dst until reading or writing
+// fails, then closes both connections.
+func spliceMessages(src, dst Conn) error {
+	for {
+		messageType, data, err := src.ReadMessage()
+
+		if err != nil {
+			var closeErr *CloseError
+
+			switch {
+			case errors.As(err, &closeErr) && validCloseCode(closeErr.Code):
+				dst.CloseWithCode(closeErr.Code, closeErr.Text)
+			case errors.As(err, &closeErr):
+				dst.CloseWithCode(CloseNormalClosure, "")
+			default:
+				dst.CloseWithCode(CloseGoingAway, "")
+			}
+
+			src.Close()
+
+			return err
+		}
+
+		if err := dst.WriteMessage(messageType, data); err != nil {
+			src.CloseWithCode(CloseGoingAway, "")
+			dst.Close()
+
+			return err
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package ws
+
+import "testing"
+
+func TestSplice(t *testing.T) {
+	upstreamErr := make(chan error, 1)
+
+	upstream := newTestServer(t, &Upgrader{}, func(conn Conn) {
+		for {
+			messageType, data, err := conn.ReadMessage()
+
+			if err != nil {
+				upstreamErr <- err
+				return
+			}
+
+			conn.WriteMessage(messageType, append([]byte("echo: "), data...))
+		}
+	})
+
+	spliced := make(chan error, 1)
+
+	proxy := newTestServer(t, &Upgrader{}, func(conn Conn) {
+		up, err := Dial(upstream)
+
+		if err != nil {
+			spliced <- err
+			return
+		}
+
+		spliced <- Splice(conn, up)
+	})
+
+	conn, err := Dial(proxy)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	for _, m := range []struct {
+		messageType int
+		data        string
+	}{{TextMessage, "hello"}, {BinaryMessage, "\x00\x01"}} {
+		if err := conn.WriteMessage(m.messageType, []byte(m.data)); err != nil {
+			t.Fatal(err)
+		}
+
+		messageType, data, err := conn.ReadMessage()
+
+		if err != nil || messageType != m.messageType || string(data) != "echo: "+m.data {
+			t.Fatalf("got type %d, %q and %v through the proxy", messageType, data, err)
+		}
+	}
+
+	// The client's status code and reason reach the upstream server.
+	conn.CloseWithCode(4001, "done")
+
+	if err := <-upstreamErr; !isCloseError(err, 4001, "done") {
+		t.Fatalf("upstream got %v, want the client's close", err)
+	}
+
+	if err := <-spliced; !isCloseError(err, 4001, "done") {
+		t.Fatalf("Splice returned %v, want the client's close", err)
+	}
+}
+
+func TestSpliceUpstreamClose(t *testing.T) {
+	upstream := newTestServer(t, &Upgrader{}, func(conn Conn) {
+		conn.ReadMessage()
+		conn.CloseWithCode(CloseNormalClosure, "bye")
+	})
+
+	spliced := make(chan error, 1)
+
+	proxy := newTestServer(t, &Upgrader{}, func(conn Conn) {
+		up, err := Dial(upstream)
+
+		if err != nil {
+			spliced <- err
+			return
+		}
+
+		spliced <- Splice(conn, up)
+	})
+
+	conn, err := Dial(proxy)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.WriteMessage(TextMessage, []byte("stop"))
+
+	if _, _, err := conn.ReadMessage(); !isCloseError(err, CloseNormalClosure, "bye") {
+		t.Fatalf("client got %v, want the upstream close", err)
+	}
+
+	// A normal closure ends Splice without an error.
+	if err := <-spliced; err != nil {
+		t.Fatalf("Splice returned %v, want nil", err)
+	}
+}
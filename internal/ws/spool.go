@@ -0,0 +1,102 @@
+package ws
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// SpooledMessage is a message returned by ReadMessageSpooled. It is backed
+// either by memory or by a temporary file which is removed by Close.
+type SpooledMessage interface {
+	io.ReadSeeker
+	io.Closer
+	// Size returns the length of the message in bytes.
+	Size() int64
+}
+
+// spoolWriter buffers a message in memory until it grows past threshold,
+// at which point it moves it to a temporary file.
+type spoolWriter struct {
+	threshold int64
+	buffer    bytes.Buffer
+	file      *os.File
+	size      int64
+}
+
+func (w *spoolWriter) Write(p []byte) (int, error) {
+	w.size += int64(len(p))
+
+	if w.file != nil {
+		return w.file.Write(p)
+	}
+
+	if w.threshold <= 0 || w.size <= w.threshold {
+		return w.buffer.Write(p)
+	}
+
+	file, err := os.CreateTemp("", "ws-message-*")
+
+	if err != nil {
+		return 0, err
+	}
+
+	w.file = file
+
+	if _, err := w.file.Write(w.buffer.Bytes()); err != nil {
+		return 0, err
+	}
+
+	w.buffer = bytes.Buffer{}
+
+	return w.file.Write(p)
+}
+
+// message returns the spooled message, ready to be read from the start.
+func (w *spoolWriter) message() (SpooledMessage, error) {
+	if w.file == nil {
+		return &memoryMessage{Reader: bytes.NewReader(w.buffer.Bytes())}, nil
+	}
+
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		w.discard()
+		return nil, err
+	}
+
+	return &fileMessage{File: w.file, size: w.size}, nil
+}
+
+// discard removes the temporary file, if any.
+func (w *spoolWriter) discard() {
+	if w.file != nil {
+		w.file.Close()
+		os.Remove(w.file.Name())
+	}
+}
+
+type memoryMessage struct {
+	*bytes.Reader
+}
+
+func (m *memoryMessage) Close() error {
+	return nil
+}
+
+type fileMessage struct {
+	*os.File
+	size int64
+}
+
+func (m *fileMessage) Size() int64 {
+	return m.size
+}
+
+func (m *fileMessage) Close() error {
+	err := m.File.Close()
+
+	if removeErr := os.Remove(m.Name()); err == nil {
+		err = removeErr
+	}
+
+	return err
+}
@@ -0,0 +1,71 @@
+package ws
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/asynched/golang-websocket-impl/internal/wstest"
+)
+
+func TestReadMessageSpooled(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+
+	large := make([]byte, 5000)
+
+	for i := range large {
+		large[i] = byte(i)
+	}
+
+	in := bytes.Join([][]byte{
+		wstest.BuildFrame(true, opCodeText, true, testMask, []byte("small")),
+		wstest.BuildFrame(false, opCodeBinary, true, testMask, large[:3000]),
+		wstest.BuildFrame(true, opCodeContinuation, true, testMask, large[3000:]),
+	}, nil)
+
+	c := newTestConn(bytes.NewReader(in), io.Discard)
+	c.spoolThreshold = 1000
+
+	tests := []struct {
+		messageType int
+		data        []byte
+		spooled     bool
+	}{
+		{TextMessage, []byte("small"), false},
+		{BinaryMessage, large, true},
+	}
+
+	for _, tt := range tests {
+		messageType, message, err := c.ReadMessageSpooled()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries, _ := os.ReadDir(dir)
+
+		if spooled := len(entries) == 1; spooled != tt.spooled {
+			t.Fatalf("%d byte message spooled to a file: %v, want %v", len(tt.data), spooled, tt.spooled)
+		}
+
+		data, err := io.ReadAll(message)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if messageType != tt.messageType || message.Size() != int64(len(tt.data)) || !bytes.Equal(data, tt.data) {
+			t.Fatalf("got a %d byte message of type %d, want the %d bytes sent", message.Size(), messageType, len(tt.data))
+		}
+
+		if err := message.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Fatalf("%s left behind once the message was closed", entries[0].Name())
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package ws
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ConnSummary describes a connection once it is closed, see
+// Upgrader.OnConnectionClose.
+type ConnSummary struct {
+	// RemoteAddr is the address of the peer, empty if the transport is not
+	// a net.Conn.
+	RemoteAddr string
+	// Duration is the time elapsed between the upgrade and the close.
+	Duration time.Duration
+	// BytesRead and BytesWritten count the payload bytes of the frames
+	// received and sent, frame headers excluded.
+	BytesRead    int64
+	BytesWritten int64
+	// MessagesRead and MessagesWritten count the data messages received
+	// and sent, control frames excluded.
+	MessagesRead    int64
+	MessagesWritten int64
+	// CloseCode is the status code of the Close frame received from the
+	// peer, or else of the one sent to it, or CloseAbnormalClosure if the
+	// connection was closed without a closing handshake.
+	CloseCode int
+	// Err is the reason the connection was closed, as reported by Wait.
+	Err error
+}
+
+// connStats holds the counters a ConnSummary is built from. They are
+// updated by the reading and writing goroutines, hence atomic.
+type connStats struct {
+	start           time.Time
+	bytesRead       atomic.Int64
+	bytesWritten    atomic.Int64
+	messagesRead    atomic.Int64
+	messagesWritten atomic.Int64
+	closeCodeSent   atomic.Int64
+}
+
+func (s *connStats) frameRead(fin bool, opCode byte, payloadLength int) {
+	s.bytesRead.Add(int64(payloadLength))
+
+	if fin && opCode&0x08 == 0 {
+		s.messagesRead.Add(1)
+	}
+}
+
+func (s *connStats) frameWrite(fin bool, opCode byte, payloadLength int) {
+	s.bytesWritten.Add(int64(payloadLength))
+
+	if fin && opCode&0x08 == 0 {
+		s.messagesWritten.Add(1)
+	}
+}
+
+// summary builds the ConnSummary of c, which must be closed.
+func (c *connImpl) summary() ConnSummary {
+	s := ConnSummary{
+		Duration:        time.Since(c.stats.start),
+		BytesRead:       c.stats.bytesRead.Load(),
+		BytesWritten:    c.stats.bytesWritten.Load(),
+		MessagesRead:    c.stats.messagesRead.Load(),
+		MessagesWritten: c.stats.messagesWritten.Load(),
+		CloseCode:       int(c.stats.closeCodeSent.Load()),
+		Err:             c.closeReason,
+	}
+
+	if conn, ok := c.conn.(net.Conn); ok {
+		s.RemoteAddr = conn.RemoteAddr().String()
+	}
+
+	var closeErr *CloseError
+
+	if errors.As(c.closeReason, &closeErr) {
+		s.CloseCode = closeErr.Code
+	} else if s.CloseCode == 0 {
+		s.CloseCode = CloseAbnormalClosure
+	}
+
+	return s
+}
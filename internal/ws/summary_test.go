@@ -0,0 +1,70 @@
+package ws
+
+import (
+	"context"
+	"testing"
+)
+
+func TestConnSummary(t *testing.T) {
+	summaries := make(chan ConnSummary, 1)
+
+	u := &Upgrader{OnConnectionClose: func(summary ConnSummary) { summaries <- summary }}
+	url := newTestServer(t, u, echo)
+
+	conn, err := Dial(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.WriteMessage(TextMessage, []byte("hello"))
+	conn.ReadMessage()
+
+	// The pong answering the ping arrives before the echo of "ab".
+	conn.PingWithData([]byte("p"))
+	conn.WriteMessage(BinaryMessage, []byte("ab"))
+	conn.ReadMessage()
+
+	conn.CloseWithCode(4000, "bye")
+
+	s := <-summaries
+
+	if s.RemoteAddr == "" || s.Duration <= 0 {
+		t.Fatalf("got remote address %q and duration %v", s.RemoteAddr, s.Duration)
+	}
+
+	// Control frames count towards the bytes but not the messages: the
+	// server read "hello", "ab", the ping and the 5 byte Close payload,
+	// and wrote the echoes, the pong and its 2 byte Close frame.
+	if s.MessagesRead != 2 || s.MessagesWritten != 2 || s.BytesRead != 13 || s.BytesWritten != 10 {
+		t.Fatalf("got %d/%d messages and %d/%d bytes read/written, want 2/2 and 13/10",
+			s.MessagesRead, s.MessagesWritten, s.BytesRead, s.BytesWritten)
+	}
+
+	if s.CloseCode != 4000 || !isCloseError(s.Err, 4000, "bye") {
+		t.Fatalf("got close code %d and error %v, want the client's close", s.CloseCode, s.Err)
+	}
+}
+
+func TestConnSummaryAbnormalClosure(t *testing.T) {
+	summaries := make(chan ConnSummary, 1)
+
+	u := &Upgrader{OnConnectionClose: func(summary ConnSummary) { summaries <- summary }}
+	// Serve closes the connection with the read error that ended it.
+	url := newTestServer(t, u, func(conn Conn) { conn.Serve(context.Background()) })
+
+	conn, err := Dial(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Dropping the connection skips the closing handshake.
+	conn.UnderlyingConn().Close()
+
+	if s := <-summaries; s.CloseCode != CloseAbnormalClosure || s.Err == nil {
+		t.Fatalf("got close code %d and error %v, want CloseAbnormalClosure", s.CloseCode, s.Err)
+	}
+}
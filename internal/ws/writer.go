@@ -0,0 +1,146 @@
+package ws
+
+import (
+	"errors"
+	"io"
+)
+
+// messageWriterBufferSize is the amount of data a messageWriter collects
+// before sending it as a frame.
+const messageWriterBufferSize = 4096
+
+// ErrWriterClosed is returned when writing to a message writer that was
+// already closed.
+var ErrWriterClosed = errors.New("message writer is closed")
+
+// messageWriter streams a message as a sequence of frames, see
+// Conn.NextWriter.
+type messageWriter struct {
+	c      *connImpl
+	opCode byte
+	buf    []byte
+	err    error
+}
+
+func (c *connImpl) NextWriter(messageType int) (io.WriteCloser, error) {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return nil, ErrInvalidMessageType
+	}
+
+	return &messageWriter{
+		c:      c,
+		opCode: byte(messageType),
+		buf:    make([]byte, 0, messageWriterBufferSize),
+	}, nil
+}
+
+func (c *connImpl) WriteFrom(messageType int, r io.Reader) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return ErrInvalidMessageType
+	}
+
+	w := &messageWriter{
+		c:      c,
+		opCode: byte(messageType),
+		buf:    make([]byte, 0, messageWriterBufferSize),
+	}
+
+	if _, err := w.ReadFrom(r); err != nil {
+		// A failed write is already recorded by the connection, and a read
+		// error before the first frame went out leaves nothing to undo.
+		if w.err != nil || w.opCode != opCodeContinuation {
+			return err
+		}
+
+		return w.c.abort(CloseInternalServerErr, err)
+	}
+
+	return w.Close()
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	written := 0
+
+	for len(p) > 0 {
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// ReadFrom reads r until EOF straight into the frame buffer, sending it
+// every time it fills up.
+func (w *messageWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	read := int64(0)
+
+	for {
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(false); err != nil {
+				return read, err
+			}
+		}
+
+		n, err := r.Read(w.buf[len(w.buf):cap(w.buf)])
+		w.buf = w.buf[:len(w.buf)+n]
+		read += int64(n)
+
+		if err == io.EOF {
+			return read, nil
+		}
+
+		if err != nil {
+			return read, err
+		}
+	}
+}
+
+// Close sends the buffered data as the final frame of the message.
+func (w *messageWriter) Close() error {
+	if w.err != nil {
+		if w.err == ErrWriterClosed {
+			return nil
+		}
+
+		return w.err
+	}
+
+	if err := w.flush(true); err != nil {
+		return err
+	}
+
+	w.err = ErrWriterClosed
+
+	return nil
+}
+
+// flush sends the buffered data as a frame. The write lock is only held
+// for the frame itself, so control frames can be sent between the
+// fragments of the message as section 5.4 of RFC 6455 allows.
+func (w *messageWriter) flush(fin bool) error {
+	if err := w.c.writeRawFrame(fin, 0, w.opCode, w.buf); err != nil {
+		w.err = err
+		return err
+	}
+
+	w.opCode = opCodeContinuation
+	w.buf = w.buf[:0]
+
+	return nil
+}
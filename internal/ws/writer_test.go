@@ -0,0 +1,105 @@
+package ws
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestNextWriterInterleavedPing(t *testing.T) {
+	var out bytes.Buffer
+	c := newTestConn(bytes.NewReader(nil), &out)
+
+	w, err := c.NextWriter(BinaryMessage)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := bytes.Repeat([]byte{'a'}, messageWriterBufferSize+1)
+
+	// Overflowing the buffer sends the first fragment, the ping follows it
+	// before the rest of the message.
+	if _, err := w.Write(first); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Write([]byte("bc")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{0x02, 126, messageWriterBufferSize >> 8, messageWriterBufferSize & 0xFF}
+	want = append(want, first[:messageWriterBufferSize]...)
+	want = append(want, 0x89, 0x00)
+	want = append(want, 0x80, 0x03, 'a', 'b', 'c')
+
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("got frames % x, want % x", out.Bytes(), want)
+	}
+}
+
+func TestWriteFromPipe(t *testing.T) {
+	pr, pw := io.Pipe()
+	data := bytes.Repeat([]byte("0123456789"), messageWriterBufferSize/4)
+
+	go func() {
+		for i := 0; i < len(data); i += 1000 {
+			pw.Write(data[i:min(i+1000, len(data))])
+		}
+
+		pw.Close()
+	}()
+
+	out := new(bytes.Buffer)
+	c := newTestConn(bytes.NewReader(nil), out)
+
+	if err := c.WriteFrom(BinaryMessage, pr); err != nil {
+		t.Fatal(err)
+	}
+
+	// The message spans several frames and reads back whole.
+	r := newTestConn(bytes.NewReader(out.Bytes()), io.Discard)
+	r.isClient = true
+
+	messageType, got, err := r.ReadMessage()
+
+	if err != nil || messageType != BinaryMessage || !bytes.Equal(got, data) {
+		t.Fatalf("read back type %d, %d bytes and %v", messageType, len(got), err)
+	}
+
+	if out.Bytes()[0] != opCodeBinary {
+		t.Fatalf("first frame header %x, want a non-final binary frame", out.Bytes()[0])
+	}
+}
+
+func TestWriteFromPipeError(t *testing.T) {
+	pr, pw := io.Pipe()
+	errBroken := errors.New("source broke")
+
+	go func() {
+		pw.Write(make([]byte, messageWriterBufferSize+1))
+		pw.CloseWithError(errBroken)
+	}()
+
+	out := new(bytes.Buffer)
+	c := newTestConn(bytes.NewReader(nil), out)
+
+	if err := c.WriteFrom(BinaryMessage, pr); err != errBroken {
+		t.Fatalf("got %v, want %v", err, errBroken)
+	}
+
+	// The first frame went out, so the message is abandoned by failing
+	// the connection.
+	if want := closeFrame(CloseInternalServerErr, ""); !bytes.HasSuffix(out.Bytes(), want) {
+		t.Fatalf("wrote %x, want it to end with %x", out.Bytes(), want)
+	}
+}
@@ -0,0 +1,52 @@
+// Package wstest provides helpers to exercise the ws package at the wire
+// level.
+package wstest
+
+import "encoding/binary"
+
+// BuildFrame returns the exact bytes of a websocket frame as described in
+// section 5.2 of RFC 6455. The payload is masked with maskKey when masked
+// is set. No validation is performed, so that malformed frames can be
+// built as well, e.g. control frames with oversized payloads or opcodes
+// with reserved bits set: opcode is written to the first byte as is,
+// besides the FIN bit.
+func BuildFrame(fin bool, opcode byte, masked bool, maskKey [4]byte, payload []byte) []byte {
+	frame := make([]byte, 0, 14+len(payload))
+
+	b0 := opcode
+
+	if fin {
+		b0 |= 0x80
+	}
+
+	frame = append(frame, b0)
+
+	var maskBit byte
+
+	if masked {
+		maskBit = 0x80
+	}
+
+	switch length := len(payload); {
+	case length <= 125:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+
+	if !masked {
+		return append(frame, payload...)
+	}
+
+	frame = append(frame, maskKey[:]...)
+
+	for i, b := range payload {
+		frame = append(frame, b^maskKey[i%4])
+	}
+
+	return frame
+}
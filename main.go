@@ -20,8 +20,6 @@ func main() {
 
 		if err != nil {
 			log.Printf("Failed to upgrade connection: %v\n", err)
-
-			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 